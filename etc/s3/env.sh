@@ -6,3 +6,15 @@ ISUCON_DB_NAME="isuride"
 
 # マッチング間隔（秒）
 ISUCON_MATCHING_INTERVAL=0.5
+
+# マッチング戦略 (greedy / optimal)
+ISUCON_MATCHING_STRATEGY=greedy
+
+# イスの不自然な移動の扱い (off / flag / reject)
+ISUCON_MOVEMENT_CHECK=flag
+
+# イスからのリクエストが途絶えてオフラインとみなすまでの時間（秒）
+ISUCON_CHAIR_OFFLINE_TIMEOUT=30
+
+# オーナーへの精算期間 (day / week / month)
+ISUCON_PAYOUT_PERIOD=week
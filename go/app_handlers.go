@@ -59,30 +59,13 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 初回登録キャンペーンのクーポンを付与
-	_, err = tx.ExecContext(
-		ctx,
-		"INSERT INTO coupons (user_id, code, discount) VALUES (?, ?, ?)",
-		userID, "CP_NEW2024", 3000,
-	)
-	if err != nil {
+	if _, err := grantCampaignCoupons(ctx, tx, campaignGrantSignup, userID, ""); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
 	// 招待コードを使った登録
 	if req.InvitationCode != nil && *req.InvitationCode != "" {
-		// 招待する側の招待数をチェック
-		var coupons []Coupon
-		err = tx.SelectContext(ctx, &coupons, "SELECT * FROM coupons WHERE code = ? FOR UPDATE", "INV_"+*req.InvitationCode)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-		if len(coupons) >= 3 {
-			writeError(w, http.StatusBadRequest, errors.New("この招待コードは使用できません。"))
-			return
-		}
-
 		// ユーザーチェック
 		var inviter User
 		err = tx.GetContext(ctx, &inviter, "SELECT * FROM users WHERE invitation_code = ?", *req.InvitationCode)
@@ -95,26 +78,41 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// 招待クーポン付与
-		_, err = tx.ExecContext(
-			ctx,
-			"INSERT INTO coupons (user_id, code, discount) VALUES (?, ?, ?)",
-			userID, "INV_"+*req.InvitationCode, 1500,
-		)
-		if err != nil {
+		// 招待クーポン付与。招待数の上限はキャンペーンの per_code_limit でチェックされる
+		if _, err := grantCampaignCoupons(ctx, tx, campaignGrantInvitee, userID, *req.InvitationCode); err != nil {
+			if errors.Is(err, errCouponCodeLimitExceeded) {
+				writeError(w, http.StatusBadRequest, errors.New("この招待コードは使用できません。"))
+				return
+			}
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
 		// 招待した人にもRewardを付与
-		_, err = tx.ExecContext(
-			ctx,
-			"INSERT INTO coupons (user_id, code, discount) VALUES (?, CONCAT(?, '_', FLOOR(UNIX_TIMESTAMP(NOW(3))*1000)), ?)",
-			inviter.ID, "RWD_"+*req.InvitationCode, 1000,
-		)
+		rewardCodes, err := grantCampaignCoupons(ctx, tx, campaignGrantInviter, inviter.ID, *req.InvitationCode)
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
+
+		// 招待と報酬を記録
+		if _, err := tx.ExecContext(
+			ctx,
+			"INSERT INTO referrals (invitee_id, inviter_id, invitation_code) VALUES (?, ?, ?)",
+			userID, inviter.ID, *req.InvitationCode,
+		); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		for _, code := range rewardCodes {
+			if _, err := tx.ExecContext(
+				ctx,
+				"INSERT INTO referral_rewards (invitee_id, coupon_code) VALUES (?, ?)",
+				userID, code,
+			); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+		}
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -179,6 +177,7 @@ type getAppRidesResponseItem struct {
 	Evaluation            int                          `json:"evaluation"`
 	RequestedAt           int64                        `json:"requested_at"`
 	CompletedAt           int64                        `json:"completed_at"`
+	PaymentStatus         string                       `json:"payment_status,omitempty"`
 }
 
 type getAppRidesResponseItemChair struct {
@@ -220,6 +219,11 @@ func appGetRides(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	paymentStatusMap, err := getPaymentStatusBulk(ctx, tx, ridesIDs)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
 
 	for _, ride := range rides {
 		status, ok := statusMap[ride.ID]
@@ -227,24 +231,19 @@ func appGetRides(w http.ResponseWriter, r *http.Request) {
 			writeError(w, http.StatusInternalServerError, errors.New("ride status not found"))
 			return
 		}
-		if status != "COMPLETED" {
+		if status != rideStatusCompleted {
 			continue
 		}
 
-		fare, err := calculateDiscountedFare(ctx, tx, user.ID, &ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-
 		item := getAppRidesResponseItem{
 			ID:                    ride.ID,
 			PickupCoordinate:      Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude},
 			DestinationCoordinate: Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude},
-			Fare:                  fare,
+			Fare:                  ride.TotalFare,
 			Evaluation:            *ride.Evaluation,
 			RequestedAt:           ride.CreatedAt.UnixMilli(),
 			CompletedAt:           ride.UpdatedAt.UnixMilli(),
+			PaymentStatus:         paymentStatusMap[ride.ID],
 		}
 
 		item.Chair = getAppRidesResponseItemChair{}
@@ -278,9 +277,191 @@ func appGetRides(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+type appGetCouponsResponse struct {
+	Coupons []appGetCouponsResponseItem `json:"coupons"`
+}
+
+type appGetCouponsResponseItem struct {
+	Code            string  `json:"code"`
+	Discount        int     `json:"discount"`
+	DiscountPercent *int    `json:"discount_percent,omitempty"`
+	Status          string  `json:"status"`
+	UsedBy          *string `json:"used_by,omitempty"`
+	CreatedAt       int64   `json:"created_at"`
+	ExpiresAt       *int64  `json:"expires_at,omitempty"`
+}
+
+func appGetCoupons(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value("user").(*User)
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	coupons, err := getCouponsWithExpiry(ctx, tx, user.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	items := make([]appGetCouponsResponseItem, 0, len(coupons))
+	for _, coupon := range coupons {
+		item := appGetCouponsResponseItem{
+			Code:            coupon.Code,
+			Discount:        coupon.Discount,
+			DiscountPercent: coupon.DiscountPercent,
+			Status:          coupon.status(),
+			UsedBy:          coupon.UsedBy,
+			CreatedAt:       coupon.CreatedAt.UnixMilli(),
+		}
+		if coupon.ExpiresAt != nil {
+			expiresAt := coupon.ExpiresAt.UnixMilli()
+			item.ExpiresAt = &expiresAt
+		}
+		items = append(items, item)
+	}
+
+	writeJSON(w, http.StatusOK, &appGetCouponsResponse{
+		Coupons: items,
+	})
+}
+
+type appGetReferralsResponse struct {
+	InvitationCode  string                           `json:"invitation_code"`
+	InvitesUsed     int                              `json:"invites_used"`
+	InvitesLimit    *int                             `json:"invites_limit,omitempty"`
+	Invitees        []appGetReferralsResponseInvitee `json:"invitees"`
+	Rewards         []appGetReferralsResponseReward  `json:"rewards"`
+	RewardsEarned   int                              `json:"rewards_earned"`
+	RewardsRedeemed int                              `json:"rewards_redeemed"`
+}
+
+type appGetReferralsResponseInvitee struct {
+	Username string `json:"username"`
+	JoinedAt int64  `json:"joined_at"`
+}
+
+type appGetReferralsResponseReward struct {
+	Code            string `json:"code"`
+	Discount        int    `json:"discount"`
+	DiscountPercent *int   `json:"discount_percent,omitempty"`
+	Status          string `json:"status"`
+	InviteeUsername string `json:"invitee_username"`
+	CreatedAt       int64  `json:"created_at"`
+}
+
+func appGetReferrals(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value("user").(*User)
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	invitees := []struct {
+		ID        string    `db:"id"`
+		Username  string    `db:"username"`
+		CreatedAt time.Time `db:"created_at"`
+	}{}
+	if err := tx.SelectContext(
+		ctx,
+		&invitees,
+		`SELECT users.id, users.username, referrals.created_at
+		FROM referrals INNER JOIN users ON users.id = referrals.invitee_id
+		WHERE referrals.inviter_id = ?
+		ORDER BY referrals.created_at`,
+		user.ID,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	rewards := []struct {
+		couponWithExpiry
+		InviteeID string `db:"invitee_id"`
+	}{}
+	if err := tx.SelectContext(
+		ctx,
+		&rewards,
+		`SELECT coupons.*, `+couponExpiredCondition+` AS expired, referrals.invitee_id
+		FROM referral_rewards
+		  INNER JOIN referrals ON referrals.invitee_id = referral_rewards.invitee_id
+		  INNER JOIN coupons ON coupons.user_id = referrals.inviter_id AND coupons.code = referral_rewards.coupon_code
+		WHERE referrals.inviter_id = ?
+		ORDER BY coupons.created_at`,
+		user.ID,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// 招待数の上限は招待された側のキャンペーンのうち一番厳しいもの
+	campaigns, err := getActiveCampaigns(ctx, tx, campaignGrantInvitee)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := &appGetReferralsResponse{
+		InvitationCode: user.InvitationCode,
+		InvitesUsed:    len(invitees),
+		Invitees:       make([]appGetReferralsResponseInvitee, 0, len(invitees)),
+		Rewards:        make([]appGetReferralsResponseReward, 0, len(rewards)),
+		RewardsEarned:  len(rewards),
+	}
+	for _, campaign := range campaigns {
+		if campaign.PerCodeLimit != nil && (res.InvitesLimit == nil || *campaign.PerCodeLimit < *res.InvitesLimit) {
+			res.InvitesLimit = campaign.PerCodeLimit
+		}
+	}
+
+	usernames := make(map[string]string, len(invitees))
+	for _, invitee := range invitees {
+		usernames[invitee.ID] = invitee.Username
+		res.Invitees = append(res.Invitees, appGetReferralsResponseInvitee{
+			Username: invitee.Username,
+			JoinedAt: invitee.CreatedAt.UnixMilli(),
+		})
+	}
+	for _, reward := range rewards {
+		status := reward.status()
+		if status == couponStatusUsed {
+			res.RewardsRedeemed++
+		}
+		res.Rewards = append(res.Rewards, appGetReferralsResponseReward{
+			Code:            reward.Code,
+			Discount:        reward.Discount,
+			DiscountPercent: reward.DiscountPercent,
+			Status:          status,
+			InviteeUsername: usernames[reward.InviteeID],
+			CreatedAt:       reward.CreatedAt.UnixMilli(),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
 type appPostRidesRequest struct {
 	PickupCoordinate      *Coordinate `json:"pickup_coordinate"`
 	DestinationCoordinate *Coordinate `json:"destination_coordinate"`
+	CouponCode            *string     `json:"coupon_code"`
 }
 
 type appPostRidesResponse struct {
@@ -371,7 +552,7 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	for _, rideID := range ridesIDs {
-		if statusMap[rideID] != "COMPLETED" {
+		if !isRideFinished(statusMap[rideID]) {
 			continuingRideCount++
 		}
 	}
@@ -381,116 +562,78 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if _, err := tx.ExecContext(
-		ctx,
-		`INSERT INTO rides (id, user_id, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude)
-				  VALUES (?, ?, ?, ?, ?, ?)`,
-		rideID, user.ID, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude,
-	); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
+	var coupon *Coupon
+	if req.CouponCode != nil && *req.CouponCode != "" {
+		// 指定されたクーポンを使う
+		coupon, err = findCouponByCode(ctx, tx, user.ID, *req.CouponCode, true)
+	} else {
+		// 指定が無ければ、初回利用なら初回利用向けのクーポンを優先して使う
+		coupon, err = findUsableCoupon(ctx, tx, user.ID, len(ridesIDs) == 0, true)
+	}
+	if err != nil {
+		writeCouponError(w, err)
 		return
 	}
+	if coupon != nil {
+		if _, err := tx.ExecContext(
+			ctx,
+			"UPDATE coupons SET used_by = ? WHERE user_id = ? AND code = ?",
+			rideID, user.ID, coupon.Code,
+		); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
 
+	// 運賃はライド作成時点のサージ倍率とクーポンで確定させる
+	surgePercent := currentSurgePercent(req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude)
+	fare := quoteFare(req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude, surgePercent, coupon)
 	if _, err := tx.ExecContext(
 		ctx,
-		`INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)`,
-		ulid.Make().String(), rideID, "MATCHING",
+		`INSERT INTO rides (id, user_id, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude, surge_percent, base_fare, metered_fare, surge_fare, discount, total_fare)
+				  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		rideID, user.ID, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude,
+		fare.SurgePercent, fare.BaseFare, fare.MeteredFare, fare.SurgeFare, fare.Discount, fare.TotalFare,
 	); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	var rideCount int
-	if err := tx.GetContext(ctx, &rideCount, `SELECT COUNT(*) FROM rides WHERE user_id = ? `, user.ID); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
+	if err := transitRideStatus(ctx, tx, rideID, rideStatusMatching); err != nil {
+		writeRideStatusError(w, err)
 		return
 	}
 
-	var coupon Coupon
-	if rideCount == 1 {
-		// 初回利用で、初回利用クーポンがあれば必ず使う
-		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND code = 'CP_NEW2024' AND used_by IS NULL FOR UPDATE", user.ID); err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
-				writeError(w, http.StatusInternalServerError, err)
-				return
-			}
-
-			// 無ければ他のクーポンを付与された順番に使う
-			if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1 FOR UPDATE", user.ID); err != nil {
-				if !errors.Is(err, sql.ErrNoRows) {
-					writeError(w, http.StatusInternalServerError, err)
-					return
-				}
-			} else {
-				if _, err := tx.ExecContext(
-					ctx,
-					"UPDATE coupons SET used_by = ? WHERE user_id = ? AND code = ?",
-					rideID, user.ID, coupon.Code,
-				); err != nil {
-					writeError(w, http.StatusInternalServerError, err)
-					return
-				}
-			}
-		} else {
-			if _, err := tx.ExecContext(
-				ctx,
-				"UPDATE coupons SET used_by = ? WHERE user_id = ? AND code = 'CP_NEW2024'",
-				rideID, user.ID,
-			); err != nil {
-				writeError(w, http.StatusInternalServerError, err)
-				return
-			}
-		}
-	} else {
-		// 他のクーポンを付与された順番に使う
-		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1 FOR UPDATE", user.ID); err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
-				writeError(w, http.StatusInternalServerError, err)
-				return
-			}
-		} else {
-			if _, err := tx.ExecContext(
-				ctx,
-				"UPDATE coupons SET used_by = ? WHERE user_id = ? AND code = ?",
-				rideID, user.ID, coupon.Code,
-			); err != nil {
-				writeError(w, http.StatusInternalServerError, err)
-				return
-			}
-		}
-	}
-
 	ride := Ride{}
 	if err := tx.GetContext(ctx, &ride, "SELECT * FROM rides WHERE id = ?", rideID); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	fare, err := calculateDiscountedFare(ctx, tx, user.ID, &ride, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
 	if err := tx.Commit(); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
+	notifyRideStatus(&ride)
+	triggerMatching()
+
 	writeJSON(w, http.StatusAccepted, &appPostRidesResponse{
 		RideID: rideID,
-		Fare:   fare,
+		Fare:   ride.TotalFare,
 	})
 }
 
 type appPostRidesEstimatedFareRequest struct {
 	PickupCoordinate      *Coordinate `json:"pickup_coordinate"`
 	DestinationCoordinate *Coordinate `json:"destination_coordinate"`
+	CouponCode            *string     `json:"coupon_code"`
 }
 
 type appPostRidesEstimatedFareResponse struct {
-	Fare     int `json:"fare"`
-	Discount int `json:"discount"`
+	Fare            int     `json:"fare"`
+	Discount        int     `json:"discount"`
+	SurgeMultiplier float64 `json:"surge_multiplier"`
 }
 
 func appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
@@ -514,9 +657,14 @@ func appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
-	discounted, err := calculateDiscountedFare(ctx, tx, user.ID, nil, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
+	var coupon *Coupon
+	if req.CouponCode != nil && *req.CouponCode != "" {
+		coupon, err = findCouponByCode(ctx, tx, user.ID, *req.CouponCode, false)
+	} else {
+		coupon, err = findUsableCoupon(ctx, tx, user.ID, true, false)
+	}
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
+		writeCouponError(w, err)
 		return
 	}
 
@@ -525,9 +673,12 @@ func appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	surgePercent := currentSurgePercent(req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude)
+	fare := quoteFare(req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude, surgePercent, coupon)
 	writeJSON(w, http.StatusOK, &appPostRidesEstimatedFareResponse{
-		Fare:     discounted,
-		Discount: calculateFare(req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude) - discounted,
+		Fare:            fare.TotalFare,
+		Discount:        fare.Discount,
+		SurgeMultiplier: float64(fare.SurgePercent) / 100,
 	})
 }
 
@@ -573,7 +724,7 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 	defer tx.Rollback()
 
 	ride := &Ride{}
-	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE id = ?`, rideID); err != nil {
+	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE id = ? FOR UPDATE`, rideID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			writeError(w, http.StatusNotFound, errors.New("ride not found"))
 			return
@@ -581,14 +732,8 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	status, err := getLatestRideStatus(ctx, tx, ride.ID)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
-	if status != "ARRIVED" {
-		writeError(w, http.StatusBadRequest, errors.New("not arrived yet"))
+	if err := transitRideStatus(ctx, tx, ride.ID, rideStatusCompleted); err != nil {
+		writeRideStatusError(w, err)
 		return
 	}
 
@@ -608,15 +753,6 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = tx.ExecContext(
-		ctx,
-		`INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)`,
-		ulid.Make().String(), rideID, "COMPLETED")
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
 	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE id = ?`, rideID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			writeError(w, http.StatusNotFound, errors.New("ride not found"))
@@ -626,6 +762,7 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 決済はライドの完了と同じトランザクションで payments に積み、paymentWorker が非同期に送る
 	paymentToken := &PaymentToken{}
 	if err := tx.GetContext(ctx, paymentToken, `SELECT * FROM payment_tokens WHERE user_id = ?`, ride.UserID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -636,44 +773,88 @@ func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fare, err := calculateDiscountedFare(ctx, tx, ride.UserID, ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
-	if err != nil {
+	if _, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO payments (ride_id, user_id, amount, idempotency_key) VALUES (?, ?, ?, ?)`,
+		ride.ID, ride.UserID, ride.TotalFare, ulid.Make().String(),
+	); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	paymentGatewayRequest := &paymentGatewayPostPaymentRequest{
-		Amount: fare,
+
+	if err := recordRideLedgerEntries(ctx, tx, ride); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
 	}
 
-	var paymentGatewayURL string
-	if err := tx.GetContext(ctx, &paymentGatewayURL, "SELECT value FROM settings WHERE name = 'payment_gateway_url'"); err != nil {
+	if err := tx.Commit(); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	if err := requestPaymentGatewayPostPayment(ctx, paymentGatewayURL, paymentToken.Token, paymentGatewayRequest, func() ([]Ride, error) {
-		rides := []Ride{}
-		if err := tx.SelectContext(ctx, &rides, `SELECT * FROM rides WHERE user_id = ? ORDER BY created_at ASC`, ride.UserID); err != nil {
-			return nil, err
-		}
-		return rides, nil
-	}); err != nil {
-		if errors.Is(err, erroredUpstream) {
-			writeError(w, http.StatusBadGateway, err)
+	chairIndex.setBusy(ride.ChairID.String, false)
+	notifyRideStatus(ride)
+	triggerPaymentWorker()
+
+	writeJSON(w, http.StatusOK, &appPostRideEvaluationResponse{
+		CompletedAt: ride.UpdatedAt.UnixMilli(),
+	})
+}
+
+func appPostRideCancel(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rideID := r.PathValue("ride_id")
+	user := ctx.Value("user").(*User)
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	ride := &Ride{}
+	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE id = ? FOR UPDATE`, rideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("ride not found"))
 			return
 		}
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	if ride.UserID != user.ID {
+		writeError(w, http.StatusNotFound, errors.New("ride not found"))
+		return
+	}
+
+	// 乗車後はキャンセルできない
+	if err := transitRideStatus(ctx, tx, ride.ID, rideStatusCanceled); err != nil {
+		writeRideStatusError(w, err)
+		return
+	}
+
+	if err := releaseCoupon(ctx, tx, ride.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
 
 	if err := tx.Commit(); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	writeJSON(w, http.StatusOK, &appPostRideEvaluationResponse{
-		CompletedAt: ride.UpdatedAt.UnixMilli(),
-	})
+	// イスはキャンセルの通知を受け取った時点で空きになる
+	if ride.ChairID.Valid {
+		rideCacheByChairIDMutex.Lock()
+		if cached, ok := rideCacheByChairID[ride.ChairID.String]; ok && cached.ID == ride.ID {
+			delete(rideCacheByChairID, ride.ChairID.String)
+		}
+		rideCacheByChairIDMutex.Unlock()
+		chairIndex.setBusy(ride.ChairID.String, false)
+	}
+	notifyRideStatus(ride)
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
 type appGetNotificationResponse struct {
@@ -705,6 +886,11 @@ type appGetNotificationResponseChairStats struct {
 }
 
 func appGetNotification(w http.ResponseWriter, r *http.Request) {
+	if acceptsEventStream(r) {
+		appGetNotificationStream(w, r)
+		return
+	}
+
 	ctx := r.Context()
 	user := ctx.Value("user").(*User)
 
@@ -744,45 +930,61 @@ func appGetNotification(w http.ResponseWriter, r *http.Request) {
 		status = yetSentRideStatus.Status
 	}
 
-	fare, err := calculateDiscountedFare(ctx, tx, user.ID, ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+	data, err := buildAppNotificationData(ctx, tx, ride, status)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-
 	response := &appGetNotificationResponse{
-		Data: &appGetNotificationResponseData{
-			RideID: ride.ID,
-			PickupCoordinate: Coordinate{
-				Latitude:  ride.PickupLatitude,
-				Longitude: ride.PickupLongitude,
-			},
-			DestinationCoordinate: Coordinate{
-				Latitude:  ride.DestinationLatitude,
-				Longitude: ride.DestinationLongitude,
-			},
-			Fare:      fare,
-			Status:    status,
-			CreatedAt: ride.CreatedAt.UnixMilli(),
-			UpdateAt:  ride.UpdatedAt.UnixMilli(),
-		},
+		Data:         data,
 		RetryAfterMs: 500,
 	}
 
+	if yetSentRideStatus.ID != "" {
+		_, err := tx.ExecContext(ctx, `UPDATE ride_statuses SET app_sent_at = CURRENT_TIMESTAMP(6) WHERE id = ?`, yetSentRideStatus.ID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+func buildAppNotificationData(ctx context.Context, tx *sqlx.Tx, ride *Ride, status string) (*appGetNotificationResponseData, error) {
+	data := &appGetNotificationResponseData{
+		RideID: ride.ID,
+		PickupCoordinate: Coordinate{
+			Latitude:  ride.PickupLatitude,
+			Longitude: ride.PickupLongitude,
+		},
+		DestinationCoordinate: Coordinate{
+			Latitude:  ride.DestinationLatitude,
+			Longitude: ride.DestinationLongitude,
+		},
+		Fare:      ride.TotalFare,
+		Status:    status,
+		CreatedAt: ride.CreatedAt.UnixMilli(),
+		UpdateAt:  ride.UpdatedAt.UnixMilli(),
+	}
+
 	if ride.ChairID.Valid {
 		chair := &Chair{}
 		if err := tx.GetContext(ctx, chair, `SELECT * FROM chairs WHERE id = ?`, ride.ChairID); err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
+			return nil, err
 		}
 
 		stats, err := getChairStats(ctx, tx, chair.ID)
 		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
+			return nil, err
 		}
 
-		response.Data.Chair = &appGetNotificationResponseChair{
+		data.Chair = &appGetNotificationResponseChair{
 			ID:    chair.ID,
 			Name:  chair.Name,
 			Model: chair.Model,
@@ -790,20 +992,7 @@ func appGetNotification(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	if yetSentRideStatus.ID != "" {
-		_, err := tx.ExecContext(ctx, `UPDATE ride_statuses SET app_sent_at = CURRENT_TIMESTAMP(6) WHERE id = ?`, yetSentRideStatus.ID)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-	}
-
-	if err := tx.Commit(); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
-	writeJSON(w, http.StatusOK, response)
+	return data, nil
 }
 
 func getChairStats(ctx context.Context, tx *sqlx.Tx, chairID string) (appGetNotificationResponseChairStats, error) {
@@ -849,12 +1038,12 @@ func getChairStats(ctx context.Context, tx *sqlx.Tx, chairID string) (appGetNoti
 		var arrivedAt, pickupedAt *time.Time
 		var isCompleted bool
 		for _, status := range rideStatuses {
-			if status.Status == "ARRIVED" {
+			if status.Status == rideStatusArrived {
 				arrivedAt = &status.CreatedAt
-			} else if status.Status == "CARRYING" {
+			} else if status.Status == rideStatusCarrying {
 				pickupedAt = &status.CreatedAt
 			}
-			if status.Status == "COMPLETED" {
+			if status.Status == rideStatusCompleted {
 				isCompleted = true
 			}
 		}
@@ -890,7 +1079,6 @@ type appGetNearbyChairsResponseChair struct {
 }
 
 func appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
 	latStr := r.URL.Query().Get("latitude")
 	lonStr := r.URL.Query().Get("longitude")
 	distanceStr := r.URL.Query().Get("distance")
@@ -922,164 +1110,9 @@ func appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
 
 	coordinate := Coordinate{Latitude: lat, Longitude: lon}
 
-	tx, err := db.Beginx()
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-	defer tx.Rollback()
-
-	retrievedAt := &time.Time{}
-	err = tx.GetContext(ctx, retrievedAt, `SELECT CURRENT_TIMESTAMP(6)`)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
-	chairs := []Chair{}
-	err = tx.SelectContext(
-		ctx,
-		&chairs,
-		`SELECT * FROM chairs WHERE is_active = TRUE`,
-	)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-
-	// 早期リターン
-	if len(chairs) == 0 {
-		writeJSON(w, http.StatusOK, &appGetNearbyChairsResponse{
-			Chairs:      []appGetNearbyChairsResponseChair{},
-			RetrievedAt: retrievedAt.UnixMilli(),
-		})
-	}
-
-	nearbyChairs := []appGetNearbyChairsResponseChair{}
-
-	ridesIDsMap := map[string][]string{}
-	chairIds := make([]string, len(chairs))
-	for i, chair := range chairs {
-		chairIds[i] = chair.ID
-	}
-	rides := []Ride{}
-	if len(chairIds) > 0 {
-		query, args, err := sqlx.In(`SELECT * FROM rides WHERE chair_id IN (?) ORDER BY created_at DESC`, chairIds)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-		query = tx.Rebind(query)
-		if err := tx.SelectContext(ctx, &rides, query, args...); err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-		for _, ride := range rides {
-			ridesIDsMap[ride.ChairID.String] = append(ridesIDsMap[ride.ChairID.String], ride.ID)
-		}
-	}
-
-	allRidesIDs := []string{}
-	for _, ridesIDs := range ridesIDsMap {
-		allRidesIDs = append(allRidesIDs, ridesIDs...)
-	}
-
-	allStatusMap, err := getLatestRideStatusBulk(ctx, tx, allRidesIDs)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-	}
-
-	for _, chair := range chairs {
-		ridesIDs := ridesIDsMap[chair.ID]
-		skip := false
-		statusMap := make(map[string]string, len(ridesIDs))
-		for _, rideID := range ridesIDs {
-			status, ok := allStatusMap[rideID]
-			if !ok {
-				writeError(w, http.StatusInternalServerError, errors.New("ride status not found"))
-				return
-			}
-			statusMap[rideID] = status
-		}
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-		}
-		for _, status := range statusMap {
-			if status != "COMPLETED" {
-				skip = true
-				break
-			}
-		}
-		if skip {
-			continue
-		}
-
-		if !chair.LocationLat.Valid || !chair.LocationLon.Valid {
-			continue
-		}
-		if calculateDistance(coordinate.Latitude, coordinate.Longitude, int(chair.LocationLat.Int32), int(chair.LocationLon.Int32)) <= distance {
-			nearbyChairs = append(nearbyChairs, appGetNearbyChairsResponseChair{
-				ID:    chair.ID,
-				Name:  chair.Name,
-				Model: chair.Model,
-				CurrentCoordinate: Coordinate{
-					Latitude:  int(chair.LocationLat.Int32),
-					Longitude: int(chair.LocationLon.Int32),
-				},
-			})
-		}
-	}
-
+	// イスの位置と空き状況はインメモリのインデックスから引く
 	writeJSON(w, http.StatusOK, &appGetNearbyChairsResponse{
-		Chairs:      nearbyChairs,
-		RetrievedAt: retrievedAt.UnixMilli(),
+		Chairs:      chairIndex.nearby(coordinate, distance),
+		RetrievedAt: time.Now().UnixMilli(),
 	})
 }
-
-func calculateFare(pickupLatitude, pickupLongitude, destLatitude, destLongitude int) int {
-	meteredFare := farePerDistance * calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
-	return initialFare + meteredFare
-}
-
-func calculateDiscountedFare(ctx context.Context, tx *sqlx.Tx, userID string, ride *Ride, pickupLatitude, pickupLongitude, destLatitude, destLongitude int) (int, error) {
-	var coupon Coupon
-	discount := 0
-	if ride != nil {
-		destLatitude = ride.DestinationLatitude
-		destLongitude = ride.DestinationLongitude
-		pickupLatitude = ride.PickupLatitude
-		pickupLongitude = ride.PickupLongitude
-
-		// すでにクーポンが紐づいているならそれの割引額を参照
-		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE used_by = ?", ride.ID); err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
-				return 0, err
-			}
-		} else {
-			discount = coupon.Discount
-		}
-	} else {
-		// 初回利用クーポンを最優先で使う
-		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND code = 'CP_NEW2024' AND used_by IS NULL", userID); err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
-				return 0, err
-			}
-
-			// 無いなら他のクーポンを付与された順番に使う
-			if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1", userID); err != nil {
-				if !errors.Is(err, sql.ErrNoRows) {
-					return 0, err
-				}
-			} else {
-				discount = coupon.Discount
-			}
-		} else {
-			discount = coupon.Discount
-		}
-	}
-
-	meteredFare := farePerDistance * calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
-	discountedMeteredFare := max(meteredFare-discount, 0)
-
-	return initialFare + discountedMeteredFare, nil
-}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+// キャンペーンのクーポンを付与する契機
+const (
+	// 新規登録したユーザーに付与する。クーポンコードは code そのもの
+	campaignGrantSignup = "SIGNUP"
+	// 招待コードを使って登録したユーザーに付与する。クーポンコードは code + 招待コード
+	campaignGrantInvitee = "INVITEE"
+	// 招待コードが使われたときに招待した側に付与する。クーポンコードは code + 招待コード + ULID
+	campaignGrantInviter = "INVITER"
+)
+
+const (
+	discountTypeFixed      = "FIXED"
+	discountTypePercentage = "PERCENTAGE"
+)
+
+// per_code_limit に達したコードでは付与できない
+var errCouponCodeLimitExceeded = errors.New("coupon code limit exceeded")
+
+// 付与期間中のキャンペーンを作成順に返す
+func getActiveCampaigns(ctx context.Context, tx *sqlx.Tx, grantOn string) ([]Campaign, error) {
+	campaigns := []Campaign{}
+	if err := tx.SelectContext(
+		ctx,
+		&campaigns,
+		`SELECT * FROM campaigns
+		WHERE grant_on = ?
+		  AND (starts_at IS NULL OR starts_at <= CURRENT_TIMESTAMP(6))
+		  AND (ends_at IS NULL OR ends_at > CURRENT_TIMESTAMP(6))
+		ORDER BY created_at`,
+		grantOn,
+	); err != nil {
+		return nil, err
+	}
+	return campaigns, nil
+}
+
+func campaignCouponCode(campaign *Campaign, invitationCode string) string {
+	switch campaign.GrantOn {
+	case campaignGrantInvitee:
+		return campaign.Code + invitationCode
+	case campaignGrantInviter:
+		// 招待されるたびに付与するので ULID で区別する。同じミリ秒に付与しても重複しない
+		return campaign.Code + invitationCode + "_" + ulid.Make().String()
+	default:
+		return campaign.Code
+	}
+}
+
+// grantOn に該当する付与期間中のキャンペーンのクーポンを userID に付与し、付与したクーポンのコードを返す
+// invitationCode は招待系のキャンペーンでクーポンコードを作るのに使う
+func grantCampaignCoupons(ctx context.Context, tx *sqlx.Tx, grantOn string, userID string, invitationCode string) ([]string, error) {
+	campaigns, err := getActiveCampaigns(ctx, tx, grantOn)
+	if err != nil {
+		return nil, err
+	}
+
+	codes := []string{}
+	for _, campaign := range campaigns {
+		code := campaignCouponCode(&campaign, invitationCode)
+
+		if campaign.PerCodeLimit != nil {
+			// 同じコードで付与済みのクーポンをロックして数える
+			var userIDs []string
+			if err := tx.SelectContext(ctx, &userIDs, "SELECT user_id FROM coupons WHERE code = ? FOR UPDATE", code); err != nil {
+				return nil, err
+			}
+			if len(userIDs) >= *campaign.PerCodeLimit {
+				return nil, errCouponCodeLimitExceeded
+			}
+		}
+
+		if campaign.PerUserLimit != nil {
+			var count int
+			if err := tx.GetContext(ctx, &count, "SELECT COUNT(*) FROM coupons WHERE user_id = ? AND campaign_id = ?", userID, campaign.ID); err != nil {
+				return nil, err
+			}
+			if count >= *campaign.PerUserLimit {
+				continue
+			}
+		}
+
+		// valid_days が NULL なら expires_at も NULL (無期限) になる
+		if _, err := tx.ExecContext(
+			ctx,
+			`INSERT INTO coupons (user_id, code, campaign_id, discount, discount_percent, expires_at)
+			VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP(6) + INTERVAL ? DAY)`,
+			userID, code, campaign.ID, campaign.DiscountAmount, campaign.DiscountPercent, campaign.ValidDays,
+		); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+
+	return codes, nil
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"time"
 
+	"github.com/jmoiron/sqlx"
 	"github.com/oklog/ulid/v2"
 )
 
@@ -55,6 +58,7 @@ func chairPostChairs(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	chairIndex.put(&Chair{ID: chairID, OwnerID: owner.ID, Name: req.Name, Model: req.Model, IsOnline: true})
 
 	http.SetCookie(w, &http.Cookie{
 		Path:  "/",
@@ -88,6 +92,11 @@ func chairPostActivity(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	chairIndex.setActive(chair.ID, req.IsActive)
+	if req.IsActive {
+		triggerMatching()
+	}
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -105,66 +114,241 @@ func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
 
 	chair := ctx.Value("chair").(*Chair)
 
+	recordedAt := time.Now()
+	if err := updateChairCoordinates(ctx, chair, []chairCoordinatePoint{{Coordinate: *req, recordedAt: recordedAt}}); err != nil {
+		writeChairCoordinatesError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &chairPostCoordinateResponse{
+		RecordedAt: recordedAt.UnixMilli(),
+	})
+}
+
+// 一度に送れる座標の数
+const chairCoordinatesMaxBatchSize = 1000
+
+// イスの時計とサーバーの時計がずれていてもよい幅
+const chairCoordinateClockSkew = 5 * time.Second
+
+var (
+	// 前回反映した座標より古い座標が送られてきた
+	errStaleCoordinate = errors.New("coordinate is older than the last recorded one")
+	// 未来の座標が送られてきた
+	errFutureCoordinate = errors.New("coordinate timestamp is in the future")
+)
+
+type chairPostCoordinatesRequest struct {
+	Coordinates []chairPostCoordinatesRequestPoint `json:"coordinates"`
+}
+
+type chairPostCoordinatesRequestPoint struct {
+	Latitude  int   `json:"latitude"`
+	Longitude int   `json:"longitude"`
+	Timestamp int64 `json:"timestamp"`
+}
+
+type chairPostCoordinatesResponse struct {
+	RecordedAt []int64 `json:"recorded_at"`
+}
+
+// イスが溜めておいた座標を時刻順にまとめて送る
+func chairPostCoordinates(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	req := &chairPostCoordinatesRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(req.Coordinates) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("coordinates is empty"))
+		return
+	}
+	if len(req.Coordinates) > chairCoordinatesMaxBatchSize {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("too many coordinates: max %d", chairCoordinatesMaxBatchSize))
+		return
+	}
+
+	points := make([]chairCoordinatePoint, 0, len(req.Coordinates))
+	recordedAt := make([]int64, 0, len(req.Coordinates))
+	for i, c := range req.Coordinates {
+		if c.Timestamp <= 0 {
+			writeError(w, http.StatusBadRequest, errors.New("timestamp is required"))
+			return
+		}
+		if i > 0 && c.Timestamp < req.Coordinates[i-1].Timestamp {
+			writeError(w, http.StatusBadRequest, errors.New("coordinates must be ordered by timestamp"))
+			return
+		}
+		points = append(points, chairCoordinatePoint{
+			Coordinate: Coordinate{Latitude: c.Latitude, Longitude: c.Longitude},
+			recordedAt: time.UnixMilli(c.Timestamp),
+		})
+		recordedAt = append(recordedAt, c.Timestamp)
+	}
+
+	chair := ctx.Value("chair").(*Chair)
+
+	if err := updateChairCoordinates(ctx, chair, points); err != nil {
+		writeChairCoordinatesError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &chairPostCoordinatesResponse{
+		RecordedAt: recordedAt,
+	})
+}
+
+func writeChairCoordinatesError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errImplausibleMovement) {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	if errors.Is(err, errStaleCoordinate) || errors.Is(err, errFutureCoordinate) {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeRideStatusError(w, err)
+}
+
+type chairCoordinatePoint struct {
+	Coordinate
+	recordedAt time.Time
+}
+
+// updateChairCoordinates はイスの座標を points の順に動かす
+// 移動距離は points 全体で積算し、途中の点でも乗車位置や目的地に着いていればライドの状態を進める
+func updateChairCoordinates(ctx context.Context, chair *Chair, points []chairCoordinatePoint) error {
 	tx, err := db.Beginx()
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
+		return err
 	}
 	defer tx.Rollback()
 
-	if err := tx.GetContext(ctx, chair, "SELECT * FROM chairs WHERE id = ?", chair.ID); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
+	// 同じイスの座標が並行して送られても total_distance を取りこぼさないようにロックする
+	// chair は認証のキャッシュと共有しているので、読み直した値は別の変数に入れる
+	locked := &Chair{}
+	if err := tx.GetContext(ctx, locked, "SELECT * FROM chairs WHERE id = ? FOR UPDATE", chair.ID); err != nil {
+		return err
+	}
+	// points は古い順に並んでいるので、最初と最後の点だけ見ればよい
+	// total_distance_updated_at は POST /api/chair/coordinate ではサーバーの時計で入るので、時計のずれの分は許す
+	if locked.TotalDistanceUpdatedAt.Valid && points[0].recordedAt.Before(locked.TotalDistanceUpdatedAt.Time.Add(-chairCoordinateClockSkew)) {
+		return errStaleCoordinate
+	}
+	if points[len(points)-1].recordedAt.After(time.Now().Add(chairCoordinateClockSkew)) {
+		return errFutureCoordinate
 	}
+	speed := 0
+	if currentMovementCheckMode != movementCheckOff {
+		speed, err = getChairSpeed(ctx, tx, locked.Model)
+		if err != nil {
+			return err
+		}
+	}
+
+	// 前回の座標からの経過時間で動ける距離を超えた移動は異常として扱う
 	distance := 0
-	if chair.LocationLat.Valid && chair.LocationLon.Valid {
-		distance = calculateDistance(int(chair.LocationLat.Int32), int(chair.LocationLon.Int32), req.Latitude, req.Longitude)
+	anomalies := []ChairMovementAnomaly{}
+	hasLocation := locked.LocationLat.Valid && locked.LocationLon.Valid
+	prev := Coordinate{Latitude: int(locked.LocationLat.Int32), Longitude: int(locked.LocationLon.Int32)}
+	prevAt := locked.TotalDistanceUpdatedAt
+	for _, p := range points {
+		if hasLocation {
+			d := calculateDistance(prev.Latitude, prev.Longitude, p.Latitude, p.Longitude)
+			plausible := true
+			if speed > 0 && prevAt.Valid {
+				elapsed := p.recordedAt.Sub(prevAt.Time)
+				if maxDistance := maxPlausibleDistance(speed, elapsed); d > maxDistance {
+					anomalies = append(anomalies, newChairMovementAnomaly(chair.ID, prev, p, d, elapsed, maxDistance))
+					plausible = false
+				}
+			}
+			if plausible {
+				distance += d
+			}
+		}
+		prev = p.Coordinate
+		prevAt = sql.NullTime{Time: p.recordedAt, Valid: true}
+		hasLocation = true
+	}
+	last := points[len(points)-1]
+
+	if len(anomalies) > 0 {
+		slog.Warn("implausible chair movement", slog.String("chair_id", chair.ID), slog.Int("count", len(anomalies)))
+		if currentMovementCheckMode == movementCheckReject {
+			// 座標は反映せず、異常の記録だけ残す
+			tx.Rollback()
+			if err := insertChairMovementAnomalies(ctx, db, anomalies); err != nil {
+				return err
+			}
+			return errImplausibleMovement
+		}
+		if err := insertChairMovementAnomalies(ctx, tx, anomalies); err != nil {
+			return err
+		}
 	}
-	totalDistanceUpdatedAt := time.Now()
 
 	if _, err := tx.ExecContext(
 		ctx,
 		`UPDATE chairs SET location_lat = ?, location_lon = ?, total_distance = total_distance + ?, total_distance_updated_at = ? WHERE id = ?`,
-		req.Latitude, req.Longitude, distance, totalDistanceUpdatedAt, chair.ID,
+		last.Latitude, last.Longitude, distance, last.recordedAt, chair.ID,
 	); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
+		return err
 	}
 
 	rideCacheByChairIDMutex.RLock()
 	ride, ok := rideCacheByChairID[chair.ID]
 	rideCacheByChairIDMutex.RUnlock()
+	statusChanged := false
 	if ok {
 		status, err := getLatestRideStatus(ctx, tx, ride.ID)
 		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
+			return err
 		}
-		if status != "COMPLETED" && status != "CANCELED" {
-			if req.Latitude == ride.PickupLatitude && req.Longitude == ride.PickupLongitude && status == "ENROUTE" {
-				if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "PICKUP"); err != nil {
-					writeError(w, http.StatusInternalServerError, err)
-					return
+		if !isRideFinished(status) {
+			for _, p := range points {
+				if p.Latitude == ride.PickupLatitude && p.Longitude == ride.PickupLongitude && status == rideStatusEnroute {
+					if err := transitRideStatus(ctx, tx, ride.ID, rideStatusPickup); err != nil {
+						return err
+					}
+					status = rideStatusPickup
+					statusChanged = true
 				}
-			}
 
-			if req.Latitude == ride.DestinationLatitude && req.Longitude == ride.DestinationLongitude && status == "CARRYING" {
-				if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "ARRIVED"); err != nil {
-					writeError(w, http.StatusInternalServerError, err)
-					return
+				if p.Latitude == ride.DestinationLatitude && p.Longitude == ride.DestinationLongitude && status == rideStatusCarrying {
+					if err := transitRideStatus(ctx, tx, ride.ID, rideStatusArrived); err != nil {
+						return err
+					}
+					// 到着した座標までをライドの移動履歴の区間とする
+					if _, err := tx.ExecContext(ctx, "UPDATE rides SET trace_ended_at = ? WHERE id = ?", p.recordedAt, ride.ID); err != nil {
+						return err
+					}
+					status = rideStatusArrived
+					statusChanged = true
 				}
 			}
 		}
 	}
 
 	if err := tx.Commit(); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
+		return err
 	}
 
-	writeJSON(w, http.StatusOK, &chairPostCoordinateResponse{
-		RecordedAt: totalDistanceUpdatedAt.UnixMilli(),
-	})
+	for _, p := range points {
+		recordChairLocation(ChairLocation{
+			ID:        ulid.Make().String(),
+			ChairID:   chair.ID,
+			Latitude:  p.Latitude,
+			Longitude: p.Longitude,
+			CreatedAt: p.recordedAt,
+		})
+	}
+	chairIndex.setLocation(chair.ID, last.Latitude, last.Longitude)
+	if statusChanged {
+		notifyRideStatus(ride)
+	}
+	return nil
 }
 
 type simpleUser struct {
@@ -186,6 +370,11 @@ type chairGetNotificationResponseData struct {
 }
 
 func chairGetNotification(w http.ResponseWriter, r *http.Request) {
+	if acceptsEventStream(r) {
+		chairGetNotificationStream(w, r)
+		return
+	}
+
 	ctx := r.Context()
 	chair := ctx.Value("chair").(*Chair)
 
@@ -225,8 +414,7 @@ func chairGetNotification(w http.ResponseWriter, r *http.Request) {
 		status = yetSentRideStatus.Status
 	}
 
-	user := &User{}
-	err = tx.GetContext(ctx, user, "SELECT * FROM users WHERE id = ? FOR SHARE", ride.UserID)
+	data, err := buildChairNotificationData(ctx, tx, ride, status)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
@@ -246,26 +434,83 @@ func chairGetNotification(w http.ResponseWriter, r *http.Request) {
 	}
 
 	writeJSON(w, http.StatusOK, &chairGetNotificationResponse{
-		Data: &chairGetNotificationResponseData{
-			RideID: ride.ID,
-			User: simpleUser{
-				ID:   user.ID,
-				Name: fmt.Sprintf("%s %s", user.Firstname, user.Lastname),
-			},
-			PickupCoordinate: Coordinate{
-				Latitude:  ride.PickupLatitude,
-				Longitude: ride.PickupLongitude,
-			},
-			DestinationCoordinate: Coordinate{
-				Latitude:  ride.DestinationLatitude,
-				Longitude: ride.DestinationLongitude,
-			},
-			Status: status,
-		},
+		Data:         data,
 		RetryAfterMs: 500,
 	})
 }
 
+func buildChairNotificationData(ctx context.Context, tx *sqlx.Tx, ride *Ride, status string) (*chairGetNotificationResponseData, error) {
+	user := &User{}
+	if err := tx.GetContext(ctx, user, "SELECT * FROM users WHERE id = ? FOR SHARE", ride.UserID); err != nil {
+		return nil, err
+	}
+
+	return &chairGetNotificationResponseData{
+		RideID: ride.ID,
+		User: simpleUser{
+			ID:   user.ID,
+			Name: fmt.Sprintf("%s %s", user.Firstname, user.Lastname),
+		},
+		PickupCoordinate: Coordinate{
+			Latitude:  ride.PickupLatitude,
+			Longitude: ride.PickupLongitude,
+		},
+		DestinationCoordinate: Coordinate{
+			Latitude:  ride.DestinationLatitude,
+			Longitude: ride.DestinationLongitude,
+		},
+		Status: status,
+	}, nil
+}
+
+// 割り当てられたライドを辞退して、マッチング待ちに戻す
+func chairPostRideDecline(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rideID := r.PathValue("ride_id")
+	chair := ctx.Value("chair").(*Chair)
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	ride := &Ride{}
+	if err := tx.GetContext(ctx, ride, "SELECT * FROM rides WHERE id = ? FOR UPDATE", rideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("ride not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if ride.ChairID.String != chair.ID {
+		writeError(w, http.StatusBadRequest, errors.New("not assigned to this ride"))
+		return
+	}
+
+	status, err := getLatestRideStatus(ctx, tx, ride.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := unassignRide(ctx, tx, ride, status); err != nil {
+		writeRideStatusError(w, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	rematchRide(chair.ID, ride)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
 type postChairRidesRideIDStatusRequest struct {
 	Status string `json:"status"`
 }
@@ -304,30 +549,21 @@ func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	switch req.Status {
-	// Acknowledge the ride
-	case "ENROUTE":
-		if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "ENROUTE"); err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-	// After Picking up user
-	case "CARRYING":
-		status, err := getLatestRideStatus(ctx, tx, ride.ID)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-		if status != "PICKUP" {
-			writeError(w, http.StatusBadRequest, errors.New("chair has not arrived yet"))
-			return
-		}
-		if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "CARRYING"); err != nil {
+	// イスから送れるのは ENROUTE (ライドの受諾) と CARRYING (乗車完了) だけ
+	if req.Status != rideStatusEnroute && req.Status != rideStatusCarrying {
+		writeError(w, http.StatusBadRequest, errors.New("invalid status"))
+		return
+	}
+	if err := transitRideStatus(ctx, tx, ride.ID, req.Status); err != nil {
+		writeRideStatusError(w, err)
+		return
+	}
+	// ライドを受諾して迎えに行き始めたところからをライドの移動履歴の区間とする
+	if req.Status == rideStatusEnroute {
+		if _, err := tx.ExecContext(ctx, "UPDATE rides SET trace_started_at = ? WHERE id = ?", time.Now(), ride.ID); err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
-	default:
-		writeError(w, http.StatusBadRequest, errors.New("invalid status"))
 	}
 
 	if err := tx.Commit(); err != nil {
@@ -335,5 +571,7 @@ func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	notifyRideStatus(ride)
+
 	w.WriteHeader(http.StatusNoContent)
 }
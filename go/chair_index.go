@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// 空間インデックスの区画の一辺の長さ
+const chairIndexCellSize = 50
+
+type chairIndexCell struct {
+	lat int
+	lon int
+}
+
+func chairIndexCellOf(latitude, longitude int) chairIndexCell {
+	return chairIndexCell{lat: floorDiv(latitude, chairIndexCellSize), lon: floorDiv(longitude, chairIndexCellSize)}
+}
+
+type indexedChair struct {
+	id          string
+	name        string
+	model       string
+	active      bool
+	online      bool
+	hasLocation bool
+	latitude    int
+	longitude   int
+	// 未完了のライドが割り当てられている
+	busy bool
+}
+
+// chairSpatialIndex はイスの位置と空き状況を区画ごとに持つインメモリのインデックス
+// nearby-chairs はこれだけを見て MySQL にはアクセスしない
+type chairSpatialIndex struct {
+	mu     sync.RWMutex
+	chairs map[string]*indexedChair
+	// 位置が分かっているイスだけを区画ごとに持つ
+	cells map[chairIndexCell]map[string]*indexedChair
+}
+
+func newChairSpatialIndex() *chairSpatialIndex {
+	return &chairSpatialIndex{
+		chairs: map[string]*indexedChair{},
+		cells:  map[chairIndexCell]map[string]*indexedChair{},
+	}
+}
+
+var chairIndex = newChairSpatialIndex()
+
+// load はイスの一覧と未完了のライドがあるイスの ID でインデックスを作り直す
+func (idx *chairSpatialIndex) load(chairs []Chair, busyChairIDs []string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.chairs = make(map[string]*indexedChair, len(chairs))
+	idx.cells = map[chairIndexCell]map[string]*indexedChair{}
+	for i := range chairs {
+		idx.putLocked(&chairs[i])
+	}
+	for _, id := range busyChairIDs {
+		if c, ok := idx.chairs[id]; ok {
+			c.busy = true
+		}
+	}
+}
+
+// put はイスを登録する。登録済みならライドの割り当て状態以外を上書きする
+func (idx *chairSpatialIndex) put(chair *Chair) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.putLocked(chair)
+}
+
+func (idx *chairSpatialIndex) putLocked(chair *Chair) {
+	c, ok := idx.chairs[chair.ID]
+	if !ok {
+		c = &indexedChair{id: chair.ID}
+		idx.chairs[chair.ID] = c
+	}
+	c.name = chair.Name
+	c.model = chair.Model
+	c.active = chair.IsActive
+	c.online = chair.IsOnline
+	if chair.LocationLat.Valid && chair.LocationLon.Valid {
+		idx.moveLocked(c, int(chair.LocationLat.Int32), int(chair.LocationLon.Int32))
+	}
+}
+
+// remove は退役したイスをインデックスから取り除く
+func (idx *chairSpatialIndex) remove(chairID string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	c, ok := idx.chairs[chairID]
+	if !ok {
+		return
+	}
+	if c.hasLocation {
+		cell := chairIndexCellOf(c.latitude, c.longitude)
+		delete(idx.cells[cell], c.id)
+		if len(idx.cells[cell]) == 0 {
+			delete(idx.cells, cell)
+		}
+	}
+	delete(idx.chairs, chairID)
+}
+
+func (idx *chairSpatialIndex) moveLocked(c *indexedChair, latitude, longitude int) {
+	if c.hasLocation {
+		from := chairIndexCellOf(c.latitude, c.longitude)
+		delete(idx.cells[from], c.id)
+		if len(idx.cells[from]) == 0 {
+			delete(idx.cells, from)
+		}
+	}
+	c.hasLocation = true
+	c.latitude = latitude
+	c.longitude = longitude
+	to := chairIndexCellOf(latitude, longitude)
+	if idx.cells[to] == nil {
+		idx.cells[to] = map[string]*indexedChair{}
+	}
+	idx.cells[to][c.id] = c
+}
+
+func (idx *chairSpatialIndex) setLocation(chairID string, latitude, longitude int) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if c, ok := idx.chairs[chairID]; ok {
+		idx.moveLocked(c, latitude, longitude)
+	}
+}
+
+func (idx *chairSpatialIndex) setActive(chairID string, active bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if c, ok := idx.chairs[chairID]; ok {
+		c.active = active
+	}
+}
+
+func (idx *chairSpatialIndex) setOnline(chairID string, online bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if c, ok := idx.chairs[chairID]; ok {
+		c.online = online
+	}
+}
+
+func (idx *chairSpatialIndex) setBusy(chairID string, busy bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if c, ok := idx.chairs[chairID]; ok {
+		c.busy = busy
+	}
+}
+
+// nearby は座標から distance 以内にいる、稼働中でオンラインの空いているイスを ID 順に返す
+func (idx *chairSpatialIndex) nearby(coordinate Coordinate, distance int) []appGetNearbyChairsResponseChair {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	result := []appGetNearbyChairsResponseChair{}
+	collect := func(c *indexedChair) {
+		if !c.active || !c.online || c.busy || !c.hasLocation {
+			return
+		}
+		if calculateDistance(coordinate.Latitude, coordinate.Longitude, c.latitude, c.longitude) > distance {
+			return
+		}
+		result = append(result, appGetNearbyChairsResponseChair{
+			ID:    c.id,
+			Name:  c.name,
+			Model: c.model,
+			CurrentCoordinate: Coordinate{
+				Latitude:  c.latitude,
+				Longitude: c.longitude,
+			},
+		})
+	}
+
+	if distance >= 0 {
+		from := chairIndexCellOf(coordinate.Latitude-distance, coordinate.Longitude-distance)
+		to := chairIndexCellOf(coordinate.Latitude+distance, coordinate.Longitude+distance)
+		// 見る区画が多すぎるなら全部のイスを見たほうが速い
+		if (to.lat-from.lat+1)*(to.lon-from.lon+1) <= len(idx.cells) {
+			for lat := from.lat; lat <= to.lat; lat++ {
+				for lon := from.lon; lon <= to.lon; lon++ {
+					for _, c := range idx.cells[chairIndexCell{lat: lat, lon: lon}] {
+						collect(c)
+					}
+				}
+			}
+		} else {
+			for _, c := range idx.chairs {
+				collect(c)
+			}
+		}
+	}
+
+	slices.SortFunc(result, func(a, b appGetNearbyChairsResponseChair) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return result
+}
+
+// DB からインデックスを作り直す。起動時と初期化時に呼ぶ
+func loadChairIndex(ctx context.Context) error {
+	chairs := []Chair{}
+	if err := db.SelectContext(ctx, &chairs, `SELECT * FROM chairs WHERE deleted_at IS NULL`); err != nil {
+		return err
+	}
+
+	busyChairIDs := []string{}
+	if err := db.SelectContext(
+		ctx,
+		&busyChairIDs,
+		`SELECT DISTINCT chair_id FROM rides
+		WHERE chair_id IS NOT NULL
+		  AND NOT EXISTS (SELECT 1 FROM ride_statuses WHERE ride_statuses.ride_id = rides.id AND ride_statuses.status IN (?, ?))`,
+		rideStatusCompleted, rideStatusCanceled,
+	); err != nil {
+		return err
+	}
+
+	chairIndex.load(chairs, busyChairIDs)
+	return nil
+}
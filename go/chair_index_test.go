@@ -0,0 +1,246 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math/rand/v2"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// nearbyChairsBySQLPath は以前の appGetNearbyChairs と同じく、DB の行から近くの空きイスを求める
+func nearbyChairsBySQLPath(chairs []Chair, rides []Ride, statuses map[string][]string, coordinate Coordinate, distance int) []appGetNearbyChairsResponseChair {
+	ridesIDsMap := map[string][]string{}
+	for _, ride := range rides {
+		if ride.ChairID.Valid {
+			ridesIDsMap[ride.ChairID.String] = append(ridesIDsMap[ride.ChairID.String], ride.ID)
+		}
+	}
+
+	nearbyChairs := []appGetNearbyChairsResponseChair{}
+	for _, chair := range chairs {
+		if !chair.IsActive || !chair.IsOnline {
+			continue
+		}
+		skip := false
+		for _, rideID := range ridesIDsMap[chair.ID] {
+			history := statuses[rideID]
+			if !isRideFinished(history[len(history)-1]) {
+				skip = true
+				break
+			}
+		}
+		if skip {
+			continue
+		}
+		if !chair.LocationLat.Valid || !chair.LocationLon.Valid {
+			continue
+		}
+		if calculateDistance(coordinate.Latitude, coordinate.Longitude, int(chair.LocationLat.Int32), int(chair.LocationLon.Int32)) <= distance {
+			nearbyChairs = append(nearbyChairs, appGetNearbyChairsResponseChair{
+				ID:    chair.ID,
+				Name:  chair.Name,
+				Model: chair.Model,
+				CurrentCoordinate: Coordinate{
+					Latitude:  int(chair.LocationLat.Int32),
+					Longitude: int(chair.LocationLon.Int32),
+				},
+			})
+		}
+	}
+	slices.SortFunc(nearbyChairs, func(a, b appGetNearbyChairsResponseChair) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return nearbyChairs
+}
+
+// busyChairIDsBySQL は loadChairIndex のクエリと同じく、完了もキャンセルもしていないライドがあるイスを返す
+func busyChairIDsBySQL(rides []Ride, statuses map[string][]string) []string {
+	busy := []string{}
+	for _, ride := range rides {
+		if !ride.ChairID.Valid {
+			continue
+		}
+		if !slices.Contains(statuses[ride.ID], rideStatusCompleted) && !slices.Contains(statuses[ride.ID], rideStatusCanceled) {
+			busy = append(busy, ride.ChairID.String)
+		}
+	}
+	return busy
+}
+
+type chairIndexFixture struct {
+	rng      *rand.Rand
+	chairs   []Chair
+	rides    []Ride
+	statuses map[string][]string
+	index    *chairSpatialIndex
+}
+
+func newChairIndexFixture(seed uint64, chairCount int) *chairIndexFixture {
+	f := &chairIndexFixture{
+		rng:      rand.New(rand.NewPCG(seed, seed)),
+		statuses: map[string][]string{},
+		index:    newChairSpatialIndex(),
+	}
+	for i := 0; i < chairCount; i++ {
+		chair := Chair{
+			ID:       fmt.Sprintf("chair-%03d", i),
+			Name:     fmt.Sprintf("name-%03d", i),
+			Model:    fmt.Sprintf("model-%d", i%5),
+			IsActive: f.rng.IntN(10) < 7,
+			IsOnline: f.rng.IntN(10) != 0,
+		}
+		if f.rng.IntN(10) != 0 {
+			chair.LocationLat = sql.NullInt32{Int32: int32(f.randomPosition()), Valid: true}
+			chair.LocationLon = sql.NullInt32{Int32: int32(f.randomPosition()), Valid: true}
+		}
+		f.chairs = append(f.chairs, chair)
+	}
+	// 初期状態で一部のイスにはライドを割り当てておく
+	for i := range f.chairs {
+		if f.rng.IntN(4) == 0 {
+			f.assign(i)
+			if f.rng.IntN(2) == 0 {
+				f.finishLatestRide(i, rideStatusCompleted)
+			}
+		}
+	}
+	f.index.load(f.chairs, busyChairIDsBySQL(f.rides, f.statuses))
+	return f
+}
+
+func (f *chairIndexFixture) randomPosition() int {
+	return f.rng.IntN(601) - 300
+}
+
+func (f *chairIndexFixture) latestRide(chairIdx int) *Ride {
+	for i := len(f.rides) - 1; i >= 0; i-- {
+		if f.rides[i].ChairID.Valid && f.rides[i].ChairID.String == f.chairs[chairIdx].ID {
+			return &f.rides[i]
+		}
+	}
+	return nil
+}
+
+func (f *chairIndexFixture) isBusy(chairIdx int) bool {
+	ride := f.latestRide(chairIdx)
+	if ride == nil {
+		return false
+	}
+	history := f.statuses[ride.ID]
+	return !isRideFinished(history[len(history)-1])
+}
+
+// マッチングでライドが割り当てられる
+func (f *chairIndexFixture) assign(chairIdx int) {
+	ride := Ride{
+		ID:      fmt.Sprintf("ride-%04d", len(f.rides)),
+		ChairID: sql.NullString{String: f.chairs[chairIdx].ID, Valid: true},
+	}
+	f.rides = append(f.rides, ride)
+	f.statuses[ride.ID] = []string{rideStatusMatching}
+}
+
+func (f *chairIndexFixture) finishLatestRide(chairIdx int, status string) {
+	ride := f.latestRide(chairIdx)
+	f.statuses[ride.ID] = append(f.statuses[ride.ID], status)
+}
+
+// ハンドラーやマッチングと同じ操作を DB の行とインデックスの両方に適用する
+func (f *chairIndexFixture) step() {
+	i := f.rng.IntN(len(f.chairs))
+	chair := &f.chairs[i]
+	switch f.rng.IntN(6) {
+	case 0: // chairPostCoordinate
+		lat, lon := f.randomPosition(), f.randomPosition()
+		chair.LocationLat = sql.NullInt32{Int32: int32(lat), Valid: true}
+		chair.LocationLon = sql.NullInt32{Int32: int32(lon), Valid: true}
+		f.index.setLocation(chair.ID, lat, lon)
+	case 1: // chairPostActivity
+		chair.IsActive = !chair.IsActive
+		f.index.setActive(chair.ID, chair.IsActive)
+	case 2: // runMatching
+		if chair.IsActive && !f.isBusy(i) {
+			f.assign(i)
+			f.index.setBusy(chair.ID, true)
+		}
+	case 3: // appPostRideEvaluatation / appPostRideCancel
+		if f.isBusy(i) {
+			status := rideStatusCompleted
+			if f.rng.IntN(2) == 0 {
+				status = rideStatusCanceled
+			}
+			f.finishLatestRide(i, status)
+			f.index.setBusy(chair.ID, false)
+		}
+	case 4: // chairPostRideDecline
+		if f.isBusy(i) {
+			ride := f.latestRide(i)
+			ride.ChairID = sql.NullString{}
+			f.index.setBusy(chair.ID, false)
+		}
+	case 5: // touchChair / markChairOffline
+		chair.IsOnline = !chair.IsOnline
+		f.index.setOnline(chair.ID, chair.IsOnline)
+	}
+}
+
+func (f *chairIndexFixture) assertSameAsSQLPath(t *testing.T, coordinate Coordinate, distance int) {
+	t.Helper()
+	want := nearbyChairsBySQLPath(f.chairs, f.rides, f.statuses, coordinate, distance)
+	got := f.index.nearby(coordinate, distance)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("nearby(%v, %d) = %v, want %v", coordinate, distance, got, want)
+	}
+}
+
+func TestChairSpatialIndexMatchesSQLPath(t *testing.T) {
+	distances := []int{0, 1, 10, 50, 120, 1000}
+	for seed := uint64(1); seed <= 5; seed++ {
+		t.Run(fmt.Sprintf("seed=%d", seed), func(t *testing.T) {
+			f := newChairIndexFixture(seed, 200)
+			for round := 0; round < 300; round++ {
+				f.step()
+				coordinate := Coordinate{Latitude: f.randomPosition(), Longitude: f.randomPosition()}
+				f.assertSameAsSQLPath(t, coordinate, distances[round%len(distances)])
+			}
+		})
+	}
+}
+
+func TestChairSpatialIndexLoadMatchesSQLPath(t *testing.T) {
+	f := newChairIndexFixture(42, 300)
+	for i := 0; i < 500; i++ {
+		f.step()
+	}
+	// 更新を積み重ねたインデックスと DB から作り直したインデックスが同じ結果を返す
+	reloaded := newChairSpatialIndex()
+	reloaded.load(f.chairs, busyChairIDsBySQL(f.rides, f.statuses))
+	for i := 0; i < 100; i++ {
+		coordinate := Coordinate{Latitude: f.randomPosition(), Longitude: f.randomPosition()}
+		want := f.index.nearby(coordinate, 80)
+		if got := reloaded.nearby(coordinate, 80); !reflect.DeepEqual(got, want) {
+			t.Fatalf("reloaded nearby(%v) = %v, want %v", coordinate, got, want)
+		}
+		f.assertSameAsSQLPath(t, coordinate, 80)
+	}
+}
+
+func TestChairSpatialIndexNegativeCoordinates(t *testing.T) {
+	index := newChairSpatialIndex()
+	index.load([]Chair{
+		{ID: "a", IsActive: true, IsOnline: true, LocationLat: sql.NullInt32{Int32: -1, Valid: true}, LocationLon: sql.NullInt32{Int32: -1, Valid: true}},
+		{ID: "b", IsActive: true, IsOnline: true, LocationLat: sql.NullInt32{Int32: 0, Valid: true}, LocationLon: sql.NullInt32{Int32: 0, Valid: true}},
+		{ID: "c", IsActive: true, IsOnline: true, LocationLat: sql.NullInt32{Int32: -51, Valid: true}, LocationLon: sql.NullInt32{Int32: 0, Valid: true}},
+	}, nil)
+
+	got := index.nearby(Coordinate{Latitude: 0, Longitude: 0}, 2)
+	if len(got) != 2 || got[0].ID != "a" || got[1].ID != "b" {
+		t.Fatalf("nearby across cell boundary = %v, want [a b]", got)
+	}
+	if got := index.nearby(Coordinate{Latitude: 0, Longitude: 0}, -1); len(got) != 0 {
+		t.Fatalf("nearby with negative distance = %v, want empty", got)
+	}
+}
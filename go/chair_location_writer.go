@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	chairLocationFlushInterval = 100 * time.Millisecond
+	// 1回の INSERT でまとめて書く座標の数。これだけ溜まったら次の tick を待たずに書き出す
+	chairLocationBatchSize = 1000
+)
+
+var (
+	chairLocationWriter *periodicTask
+
+	// まだ chair_locations に書いていない座標
+	pendingChairLocations []ChairLocation
+	// flushChairLocations が書き込んでいる途中の座標。コミットされるまではバッファにあるものとして読む
+	flushingChairLocations     []ChairLocation
+	pendingChairLocationsMutex sync.Mutex
+)
+
+// recordChairLocation は座標を履歴に追加する。書き込みはまとめて非同期に行う
+func recordChairLocation(location ChairLocation) {
+	// DATETIME(6) に丸められる前と後で並び順が変わらないよう、バッファにも同じ精度で持つ
+	location.CreatedAt = location.CreatedAt.Truncate(time.Microsecond)
+
+	pendingChairLocationsMutex.Lock()
+	pendingChairLocations = append(pendingChairLocations, location)
+	n := len(pendingChairLocations)
+	pendingChairLocationsMutex.Unlock()
+
+	if n >= chairLocationBatchSize {
+		chairLocationWriter.trigger()
+	}
+}
+
+func resetPendingChairLocations() {
+	pendingChairLocationsMutex.Lock()
+	defer pendingChairLocationsMutex.Unlock()
+	pendingChairLocations = nil
+}
+
+// bufferedChairLocations はまだ DB から読めないかもしれないイスの座標を返す
+// DB を読む前に呼べば、その間に書き出された座標も取りこぼさない (重複は ID で除く)
+func bufferedChairLocations(chairID string, since, until time.Time) []ChairLocation {
+	pendingChairLocationsMutex.Lock()
+	defer pendingChairLocationsMutex.Unlock()
+
+	locations := []ChairLocation{}
+	for _, buf := range [][]ChairLocation{flushingChairLocations, pendingChairLocations} {
+		for _, location := range buf {
+			if location.ChairID == chairID && !location.CreatedAt.Before(since) && !location.CreatedAt.After(until) {
+				locations = append(locations, location)
+			}
+		}
+	}
+	return locations
+}
+
+// flushChairLocations は溜まっている座標を bulk insert する
+// 失敗した分はバッファに戻して次回に書く
+func flushChairLocations(ctx context.Context) error {
+	pendingChairLocationsMutex.Lock()
+	locations := pendingChairLocations
+	pendingChairLocations = nil
+	flushingChairLocations = locations
+	pendingChairLocationsMutex.Unlock()
+
+	defer func() {
+		pendingChairLocationsMutex.Lock()
+		flushingChairLocations = nil
+		pendingChairLocationsMutex.Unlock()
+	}()
+
+	for len(locations) > 0 {
+		batch := locations[:min(len(locations), chairLocationBatchSize)]
+		if _, err := db.NamedExecContext(
+			ctx,
+			`INSERT INTO chair_locations (id, chair_id, latitude, longitude, created_at) VALUES (:id, :chair_id, :latitude, :longitude, :created_at)`,
+			batch,
+		); err != nil {
+			pendingChairLocationsMutex.Lock()
+			pendingChairLocations = append(locations, pendingChairLocations...)
+			flushingChairLocations = nil
+			pendingChairLocationsMutex.Unlock()
+			return err
+		}
+		locations = locations[len(batch):]
+		pendingChairLocationsMutex.Lock()
+		flushingChairLocations = locations
+		pendingChairLocationsMutex.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultChairOfflineTimeout = 30 * time.Second
+	chairPresenceSweepInterval = 5 * time.Second
+)
+
+var chairOfflineTimeout = defaultChairOfflineTimeout
+
+var (
+	// 最後に認証済みのリクエストを受けた時刻。sweep のたびに chairs.last_seen_at に書き出す
+	chairLastSeen = map[string]time.Time{}
+	// オフラインにしたイス。リクエストが来たらオンラインに戻す
+	offlineChairs = map[string]bool{}
+	// イスごとのロック。オフラインにする処理とオンラインに戻す処理が DB の上で入れ違わないようにする
+	chairPresenceLocks = map[string]*sync.Mutex{}
+	chairPresenceMutex sync.Mutex
+)
+
+func lockChairPresence(chairID string) func() {
+	chairPresenceMutex.Lock()
+	l, ok := chairPresenceLocks[chairID]
+	if !ok {
+		l = &sync.Mutex{}
+		chairPresenceLocks[chairID] = l
+	}
+	chairPresenceMutex.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
+func getChairOfflineTimeout() time.Duration {
+	// ISUCON_CHAIR_OFFLINE_TIMEOUT は秒単位 (例: 30)
+	v := os.Getenv("ISUCON_CHAIR_OFFLINE_TIMEOUT")
+	if v == "" {
+		return defaultChairOfflineTimeout
+	}
+	sec, err := strconv.ParseFloat(v, 64)
+	if err != nil || sec <= 0 {
+		slog.Warn("invalid ISUCON_CHAIR_OFFLINE_TIMEOUT, using default", slog.String("value", v))
+		return defaultChairOfflineTimeout
+	}
+	return time.Duration(sec * float64(time.Second))
+}
+
+// DB からオフラインのイスを読み直す。起動時と初期化時に呼ぶ
+func loadChairPresence(ctx context.Context) error {
+	ids := []string{}
+	if err := db.SelectContext(ctx, &ids, "SELECT id FROM chairs WHERE is_online = FALSE"); err != nil {
+		return err
+	}
+
+	chairPresenceMutex.Lock()
+	defer chairPresenceMutex.Unlock()
+	chairLastSeen = map[string]time.Time{}
+	offlineChairs = make(map[string]bool, len(ids))
+	for _, id := range ids {
+		offlineChairs[id] = true
+	}
+	return nil
+}
+
+// touchChair はイスの認証済みリクエストごとに呼ばれる。オフラインにしていたイスならオンラインに戻す
+func touchChair(ctx context.Context, chairID string) error {
+	now := time.Now()
+	chairPresenceMutex.Lock()
+	chairLastSeen[chairID] = now
+	wasOffline := offlineChairs[chairID]
+	chairPresenceMutex.Unlock()
+
+	if !wasOffline {
+		return nil
+	}
+
+	unlock := lockChairPresence(chairID)
+	defer unlock()
+
+	// ロックを待つ間に別のリクエストがオンラインに戻している
+	chairPresenceMutex.Lock()
+	stillOffline := offlineChairs[chairID]
+	chairPresenceMutex.Unlock()
+	if !stillOffline {
+		return nil
+	}
+
+	if _, err := db.ExecContext(ctx, "UPDATE chairs SET is_online = TRUE, last_seen_at = ? WHERE id = ?", now, chairID); err != nil {
+		return err
+	}
+	chairPresenceMutex.Lock()
+	delete(offlineChairs, chairID)
+	chairPresenceMutex.Unlock()
+	slog.Info("chair is back online", slog.String("chair_id", chairID))
+	chairIndex.setOnline(chairID, true)
+	triggerMatching()
+	return nil
+}
+
+// runChairPresenceSweep は last_seen_at を書き出し、timeout の間リクエストが無いイスをオフラインにする
+func runChairPresenceSweep(ctx context.Context) error {
+	chairPresenceMutex.Lock()
+	seen := chairLastSeen
+	chairLastSeen = map[string]time.Time{}
+	chairPresenceMutex.Unlock()
+
+	if len(seen) > 0 {
+		if err := saveChairLastSeen(ctx, seen); err != nil {
+			// 書けなかった分は次回に回す
+			chairPresenceMutex.Lock()
+			for id, t := range seen {
+				if _, ok := chairLastSeen[id]; !ok {
+					chairLastSeen[id] = t
+				}
+			}
+			chairPresenceMutex.Unlock()
+			return err
+		}
+	}
+
+	// 一度もリクエストが無いイスは登録日時から数える
+	silentChairIDs := []string{}
+	if err := db.SelectContext(
+		ctx,
+		&silentChairIDs,
+		"SELECT id FROM chairs WHERE is_online = TRUE AND deleted_at IS NULL AND COALESCE(last_seen_at, created_at) < ?",
+		time.Now().Add(-chairOfflineTimeout),
+	); err != nil {
+		return err
+	}
+
+	for _, chairID := range silentChairIDs {
+		if err := markChairOffline(ctx, chairID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// touchedSinceSweep は sweep で chairLastSeen を書き出した後にリクエストが来ているかを返す
+// chairPresenceMutex を取ってから呼ぶこと
+func touchedSinceSweep(chairID string) bool {
+	_, ok := chairLastSeen[chairID]
+	return ok
+}
+
+func saveChairLastSeen(ctx context.Context, seen map[string]time.Time) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for chairID, t := range seen {
+		if _, err := tx.ExecContext(ctx, "UPDATE chairs SET last_seen_at = ? WHERE id = ?", t, chairID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// markChairOffline はイスをオフラインにする
+// 迎えに行く途中 (ENROUTE) やまだ受諾していないライドは、割り当てを外してマッチングし直す
+// DB を書き換えてからメモリ上でオフラインにし、その間に届いたリクエストがあれば DB をオンラインに戻す
+func markChairOffline(ctx context.Context, chairID string) (err error) {
+	unlock := lockChairPresence(chairID)
+	defer unlock()
+
+	chairPresenceMutex.Lock()
+	touched := touchedSinceSweep(chairID)
+	chairPresenceMutex.Unlock()
+	if touched {
+		return nil
+	}
+
+	// コミットまでの間にマッチングで選ばれないよう、先に候補から外しておく
+	chairIndex.setOnline(chairID, false)
+	defer func() {
+		if err != nil {
+			chairIndex.setOnline(chairID, true)
+		}
+	}()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "UPDATE chairs SET is_online = FALSE WHERE id = ? AND is_online = TRUE", chairID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return nil
+	}
+
+	var unassigned *Ride
+	rides := []*Ride{}
+	if err := tx.SelectContext(ctx, &rides, "SELECT * FROM rides WHERE chair_id = ? ORDER BY updated_at DESC LIMIT 1 FOR UPDATE", chairID); err != nil {
+		return err
+	}
+	if len(rides) > 0 {
+		status, err := getLatestRideStatus(ctx, tx, rides[0].ID)
+		if err != nil {
+			return err
+		}
+		if status == rideStatusMatching || status == rideStatusEnroute {
+			if err := unassignRide(ctx, tx, rides[0], status); err != nil {
+				return err
+			}
+			unassigned = rides[0]
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	// 判定とフラグの書き込みを同じロックの中で行うので、この後のリクエストは必ずフラグを見てオンラインに戻す
+	chairPresenceMutex.Lock()
+	touched = touchedSinceSweep(chairID)
+	if !touched {
+		offlineChairs[chairID] = true
+	}
+	chairPresenceMutex.Unlock()
+
+	if touched {
+		// トランザクションの間にリクエストが来ていたので、オンラインに戻す
+		if _, err := db.ExecContext(ctx, "UPDATE chairs SET is_online = TRUE WHERE id = ?", chairID); err != nil {
+			chairPresenceMutex.Lock()
+			offlineChairs[chairID] = true
+			chairPresenceMutex.Unlock()
+			slog.Error("failed to restore chair online", slog.String("chair_id", chairID), slog.Any("error", err))
+		} else {
+			chairIndex.setOnline(chairID, true)
+		}
+	} else {
+		slog.Info("chair went offline", slog.String("chair_id", chairID))
+	}
+
+	if unassigned != nil {
+		rematchRide(chairID, unassigned)
+	}
+	return nil
+}
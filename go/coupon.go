@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const couponExpiryInterval = time.Minute
+
+const (
+	couponStatusAvailable = "AVAILABLE"
+	couponStatusUsed      = "USED"
+	couponStatusExpired   = "EXPIRED"
+)
+
+var (
+	errCouponNotFound    = errors.New("coupon not found")
+	errCouponAlreadyUsed = errors.New("coupon is already used")
+	errCouponExpired     = errors.New("coupon is expired")
+)
+
+// 期限切れのクーポン。スイープ前でも有効期限を過ぎていれば期限切れとして扱う
+const couponExpiredCondition = "(is_expired OR (expires_at IS NOT NULL AND expires_at <= CURRENT_TIMESTAMP(6)))"
+
+// 有効期限切れかどうかは DB の時刻で判定する
+type couponWithExpiry struct {
+	Coupon
+	Expired bool `db:"expired"`
+}
+
+func (c *couponWithExpiry) status() string {
+	switch {
+	case c.UsedBy != nil:
+		return couponStatusUsed
+	case c.Expired:
+		return couponStatusExpired
+	default:
+		return couponStatusAvailable
+	}
+}
+
+// ユーザーが持っているクーポンを付与された順に返す
+func getCouponsWithExpiry(ctx context.Context, tx *sqlx.Tx, userID string) ([]couponWithExpiry, error) {
+	coupons := []couponWithExpiry{}
+	if err := tx.SelectContext(
+		ctx,
+		&coupons,
+		`SELECT *, `+couponExpiredCondition+` AS expired
+		FROM coupons WHERE user_id = ? ORDER BY created_at`,
+		userID,
+	); err != nil {
+		return nil, err
+	}
+	return coupons, nil
+}
+
+// ユーザーが指定したクーポンを取得する。使用済みや期限切れのクーポンはエラーにする
+// lock するとクーポンを FOR UPDATE で取得する
+func findCouponByCode(ctx context.Context, tx *sqlx.Tx, userID string, code string, lock bool) (*Coupon, error) {
+	forUpdate := ""
+	if lock {
+		forUpdate = " FOR UPDATE"
+	}
+
+	coupon := &couponWithExpiry{}
+	if err := tx.GetContext(
+		ctx,
+		coupon,
+		`SELECT *, `+couponExpiredCondition+` AS expired
+		FROM coupons WHERE user_id = ? AND code = ?`+forUpdate,
+		userID, code,
+	); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errCouponNotFound
+		}
+		return nil, err
+	}
+
+	switch coupon.status() {
+	case couponStatusUsed:
+		return nil, errCouponAlreadyUsed
+	case couponStatusExpired:
+		return nil, errCouponExpired
+	}
+	return &coupon.Coupon, nil
+}
+
+// 指定されたクーポンが使えない場合は 400 を返す
+func writeCouponError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errCouponNotFound) || errors.Is(err, errCouponAlreadyUsed) || errors.Is(err, errCouponExpired) {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err)
+}
+
+// ライドに使うクーポンを選ぶ
+// firstRide なら初回利用時に優先するキャンペーンのクーポンを最優先し、無ければ付与された順番に使う
+// lock するとクーポンを FOR UPDATE で取得する
+func findUsableCoupon(ctx context.Context, tx *sqlx.Tx, userID string, firstRide bool, lock bool) (*Coupon, error) {
+	forUpdate := ""
+	if lock {
+		forUpdate = " FOR UPDATE"
+	}
+
+	coupon := &Coupon{}
+	if firstRide {
+		err := tx.GetContext(
+			ctx,
+			coupon,
+			`SELECT * FROM coupons
+			WHERE user_id = ? AND used_by IS NULL
+			  AND NOT `+couponExpiredCondition+`
+			  AND campaign_id IN (SELECT id FROM campaigns WHERE first_ride_priority)
+			ORDER BY created_at LIMIT 1`+forUpdate,
+			userID,
+		)
+		if err == nil {
+			return coupon, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+	}
+
+	if err := tx.GetContext(
+		ctx,
+		coupon,
+		`SELECT * FROM coupons
+		WHERE user_id = ? AND used_by IS NULL
+		  AND NOT `+couponExpiredCondition+`
+		ORDER BY created_at LIMIT 1`+forUpdate,
+		userID,
+	); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return coupon, nil
+}
+
+// 割引率のあるクーポンは fare に対する割合で、discount を上限とする
+func (c *Coupon) discountFor(fare int) int {
+	if c.DiscountPercent == nil {
+		return c.Discount
+	}
+	return min(fare**c.DiscountPercent/100, c.Discount)
+}
+
+// ライドがキャンセルされたり決済に失敗したりした場合は、使ったクーポンを未使用に戻す
+func releaseCoupon(ctx context.Context, tx *sqlx.Tx, rideID string) error {
+	_, err := tx.ExecContext(ctx, "UPDATE coupons SET used_by = NULL WHERE used_by = ?", rideID)
+	return err
+}
+
+// 有効期限を過ぎた未使用のクーポンを期限切れにする
+func runCouponExpiry(ctx context.Context) error {
+	result, err := db.ExecContext(
+		ctx,
+		`UPDATE coupons SET is_expired = 1
+		WHERE is_expired = 0 AND used_by IS NULL AND expires_at <= CURRENT_TIMESTAMP(6)`,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n > 0 {
+		slog.Info("coupons expired", slog.Int64("count", n))
+	}
+	return nil
+}
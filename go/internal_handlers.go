@@ -4,99 +4,287 @@ import (
 	"database/sql"
 	"errors"
 	"net/http"
-	"sort"
+	"time"
+
+	"github.com/oklog/ulid/v2"
 )
 
-// このAPIをインスタンス内から一定間隔で叩かせることで、椅子とライドをマッチングさせる
+// マッチングは matchingScheduler が一定間隔で実行しているが、手動で即時実行したい場合はこのAPIを叩く
 func internalGetMatching(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
-	// 待っているリクエストを取得
-	rides := []*Ride{}
-	if err := db.SelectContext(ctx, &rides, "SELECT * FROM rides WHERE chair_id IS NULL ORDER BY created_at"); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			w.WriteHeader(http.StatusNoContent)
-			return
-		}
+	if err := runMatching(ctx); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	// 空きイスとその座標を取得
-	tmp_freeChairs := []*Chair{}
-	if err := db.SelectContext(ctx, &tmp_freeChairs, "SELECT * FROM chairs WHERE is_active = TRUE AND NOT EXISTS (SELECT rides.id FROM ride_statuses JOIN rides ON ride_statuses.ride_id = rides.id WHERE rides.chair_id = chairs.id GROUP BY rides.id HAVING COUNT(*) < 6)"); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			w.WriteHeader(http.StatusNoContent)
-			return
-		}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type internalCampaign struct {
+	ID                string `json:"id"`
+	Name              string `json:"name"`
+	GrantOn           string `json:"grant_on"`
+	Code              string `json:"code"`
+	DiscountType      string `json:"discount_type"`
+	DiscountAmount    int    `json:"discount_amount"`
+	DiscountPercent   *int   `json:"discount_percent,omitempty"`
+	PerUserLimit      *int   `json:"per_user_limit,omitempty"`
+	PerCodeLimit      *int   `json:"per_code_limit,omitempty"`
+	ValidDays         *int   `json:"valid_days,omitempty"`
+	FirstRidePriority bool   `json:"first_ride_priority"`
+	StartsAt          *int64 `json:"starts_at,omitempty"`
+	EndsAt            *int64 `json:"ends_at,omitempty"`
+	CreatedAt         int64  `json:"created_at"`
+}
+
+func toInternalCampaign(campaign *Campaign) internalCampaign {
+	c := internalCampaign{
+		ID:                campaign.ID,
+		Name:              campaign.Name,
+		GrantOn:           campaign.GrantOn,
+		Code:              campaign.Code,
+		DiscountType:      campaign.DiscountType,
+		DiscountAmount:    campaign.DiscountAmount,
+		DiscountPercent:   campaign.DiscountPercent,
+		PerUserLimit:      campaign.PerUserLimit,
+		PerCodeLimit:      campaign.PerCodeLimit,
+		ValidDays:         campaign.ValidDays,
+		FirstRidePriority: campaign.FirstRidePriority,
+		CreatedAt:         campaign.CreatedAt.UnixMilli(),
+	}
+	if campaign.StartsAt != nil {
+		startsAt := campaign.StartsAt.UnixMilli()
+		c.StartsAt = &startsAt
+	}
+	if campaign.EndsAt != nil {
+		endsAt := campaign.EndsAt.UnixMilli()
+		c.EndsAt = &endsAt
+	}
+	return c
+}
+
+type internalGetCampaignsResponse struct {
+	Campaigns []internalCampaign `json:"campaigns"`
+}
+
+func internalGetCampaigns(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	campaigns := []Campaign{}
+	if err := db.SelectContext(ctx, &campaigns, "SELECT * FROM campaigns ORDER BY created_at"); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	// n + 1 しちゃうけどしゃあなし
-	freeChairs := []*Chair{}
-	for _, chair := range tmp_freeChairs {
-		isFree := true
-		if err := db.GetContext(ctx, &isFree, "SELECT COUNT(*) = 0 FROM (SELECT COUNT(chair_sent_at) = 6 AS completed FROM ride_statuses WHERE ride_id IN (SELECT id FROM rides WHERE chair_id = ?) GROUP BY ride_id) is_completed WHERE completed = FALSE", chair.ID); err != nil {
-			writeError(w, http.StatusInternalServerError, err)
+
+	res := internalGetCampaignsResponse{Campaigns: make([]internalCampaign, 0, len(campaigns))}
+	for _, campaign := range campaigns {
+		res.Campaigns = append(res.Campaigns, toInternalCampaign(&campaign))
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+type internalPostCampaignRequest struct {
+	Name              string `json:"name"`
+	GrantOn           string `json:"grant_on"`
+	Code              string `json:"code"`
+	DiscountType      string `json:"discount_type"`
+	DiscountAmount    int    `json:"discount_amount"`
+	DiscountPercent   *int   `json:"discount_percent"`
+	PerUserLimit      *int   `json:"per_user_limit"`
+	PerCodeLimit      *int   `json:"per_code_limit"`
+	ValidDays         *int   `json:"valid_days"`
+	FirstRidePriority bool   `json:"first_ride_priority"`
+	StartsAt          *int64 `json:"starts_at"`
+	EndsAt            *int64 `json:"ends_at"`
+}
+
+func (req *internalPostCampaignRequest) validate() error {
+	if req.Name == "" || req.Code == "" {
+		return errors.New("required fields(name, code) are empty")
+	}
+	switch req.GrantOn {
+	case campaignGrantSignup, campaignGrantInvitee, campaignGrantInviter:
+	default:
+		return errors.New("grant_on must be SIGNUP, INVITEE or INVITER")
+	}
+	if req.DiscountAmount <= 0 {
+		return errors.New("discount_amount must be positive")
+	}
+	switch req.DiscountType {
+	case discountTypeFixed:
+		if req.DiscountPercent != nil {
+			return errors.New("discount_percent is only for PERCENTAGE campaigns")
 		}
-		if isFree {
-			freeChairs = append(freeChairs, chair)
+	case discountTypePercentage:
+		if req.DiscountPercent == nil || *req.DiscountPercent <= 0 || *req.DiscountPercent > 100 {
+			return errors.New("discount_percent must be between 1 and 100")
 		}
+	default:
+		return errors.New("discount_type must be FIXED or PERCENTAGE")
+	}
+	if req.PerUserLimit != nil && *req.PerUserLimit <= 0 {
+		return errors.New("per_user_limit must be positive")
+	}
+	if req.PerCodeLimit != nil && *req.PerCodeLimit <= 0 {
+		return errors.New("per_code_limit must be positive")
+	}
+	if req.ValidDays != nil && *req.ValidDays <= 0 {
+		return errors.New("valid_days must be positive")
+	}
+	if req.StartsAt != nil && req.EndsAt != nil && *req.StartsAt >= *req.EndsAt {
+		return errors.New("starts_at must be before ends_at")
+	}
+	return nil
+}
+
+// クーポンキャンペーンを作成する。作成以降のユーザー登録からクーポンが付与される
+func internalPostCampaign(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	req := &internalPostCampaignRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := req.validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
 	}
 
-	// イスの性能を取得
-	tmp2 := []*ChairModel{}
-	if err := db.SelectContext(ctx, &tmp2, "SELECT * FROM chair_models"); err != nil {
+	var startsAt, endsAt *time.Time
+	if req.StartsAt != nil {
+		t := time.UnixMilli(*req.StartsAt)
+		startsAt = &t
+	}
+	if req.EndsAt != nil {
+		t := time.UnixMilli(*req.EndsAt)
+		endsAt = &t
+	}
+
+	campaignID := ulid.Make().String()
+
+	tx, err := db.Beginx()
+	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	chairModels := map[string]int{}
-	for _, model := range tmp2 {
-		chairModels[model.Name] = model.Speed
+	defer tx.Rollback()
+
+	var count int
+	if err := tx.GetContext(ctx, &count, "SELECT COUNT(*) FROM campaigns WHERE code = ?", req.Code); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if count > 0 {
+		writeError(w, http.StatusConflict, errors.New("campaign code already exists"))
+		return
 	}
 
-	// マッチング
-	sort.Slice(rides, func(i, j int) bool {
-		iDist := abs(rides[i].PickupLatitude-rides[i].DestinationLatitude) + abs(rides[i].PickupLongitude-rides[i].DestinationLongitude)
-		jDist := abs(rides[j].PickupLatitude-rides[j].DestinationLatitude) + abs(rides[j].PickupLongitude-rides[j].DestinationLongitude)
-		return iDist > jDist
-	})
-	isChairUsed := make([]bool, len(freeChairs))
-
-	for _, ride := range rides {
-		bestChairIdx := -1
-		bestTime := 1e9
-
-		for chairidx, chair := range freeChairs {
-			if isChairUsed[chairidx] || !chair.LocationLat.Valid || !chair.LocationLon.Valid {
-				continue
-			}
-			pickupDist := abs(int(chair.LocationLat.Int32)-ride.PickupLatitude) + abs(int(chair.LocationLon.Int32)-ride.PickupLongitude)
-			moveDist := abs(ride.PickupLatitude-ride.DestinationLatitude) + abs(ride.PickupLongitude-ride.DestinationLongitude)
-			speed := chairModels[chair.Model]
-			time := float64(pickupDist+moveDist*10) / float64(speed)
-			if time < bestTime {
-				bestTime = time
-				bestChairIdx = chairidx
-			}
-		}
+	if _, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO campaigns (id, name, grant_on, code, discount_type, discount_amount, discount_percent, per_user_limit, per_code_limit, valid_days, first_ride_priority, starts_at, ends_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		campaignID, req.Name, req.GrantOn, req.Code, req.DiscountType, req.DiscountAmount, req.DiscountPercent,
+		req.PerUserLimit, req.PerCodeLimit, req.ValidDays, req.FirstRidePriority, startsAt, endsAt,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
 
-		if bestChairIdx == -1 {
-			continue
-		}
+	campaign := Campaign{}
+	if err := tx.GetContext(ctx, &campaign, "SELECT * FROM campaigns WHERE id = ?", campaignID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, toInternalCampaign(&campaign))
+}
+
+type internalChairModel struct {
+	Name              string `json:"name"`
+	Speed             int    `json:"speed"`
+	CommissionPercent int    `json:"commission_percent"`
+}
+
+type internalGetChairModelsResponse struct {
+	ChairModels []internalChairModel `json:"chair_models"`
+}
+
+func internalGetChairModels(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	models := []ChairModel{}
+	if err := db.SelectContext(ctx, &models, "SELECT * FROM chair_models ORDER BY name"); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := internalGetChairModelsResponse{ChairModels: make([]internalChairModel, 0, len(models))}
+	for _, model := range models {
+		res.ChairModels = append(res.ChairModels, internalChairModel{
+			Name:              model.Name,
+			Speed:             model.Speed,
+			CommissionPercent: model.CommissionPercent,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+type internalPatchChairModelRequest struct {
+	CommissionPercent *int `json:"commission_percent"`
+}
+
+// イスのモデルごとの手数料率を変える。計上済みの仕訳には影響せず、以降に完了したライドから適用される
+func internalPatchChairModel(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	name := r.PathValue("model")
+
+	req := &internalPatchChairModelRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.CommissionPercent == nil || *req.CommissionPercent < 0 || *req.CommissionPercent > 100 {
+		writeError(w, http.StatusBadRequest, errors.New("commission_percent must be between 0 and 100"))
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
 
-		isChairUsed[bestChairIdx] = true
-		if _, err := db.ExecContext(ctx, "UPDATE rides SET chair_id = ? WHERE id = ?", freeChairs[bestChairIdx].ID, ride.ID); err != nil {
-			writeError(w, http.StatusInternalServerError, err)
+	model := ChairModel{}
+	if err := tx.GetContext(ctx, &model, "SELECT * FROM chair_models WHERE name = ? FOR UPDATE", name); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errUnknownChairModel)
 			return
 		}
-		rideCacheByChairIDMutex.Lock()
-		rideCacheByChairID[freeChairs[bestChairIdx].ID] = ride
-		rideCacheByChairIDMutex.Unlock()
-		chairByAuthTokenCacheMutex.Lock()
-		delete(chairByAuthTokenCache, freeChairs[bestChairIdx].AccessToken)
-		chairByAuthTokenCacheMutex.Unlock()
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE chair_models SET commission_percent = ? WHERE name = ?", *req.CommissionPercent, name); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
 	}
 
-	w.WriteHeader(http.StatusNoContent)
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &internalChairModel{
+		Name:              model.Name,
+		Speed:             model.Speed,
+		CommissionPercent: *req.CommissionPercent,
+	})
 }
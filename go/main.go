@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	crand "crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"log/slog"
@@ -10,8 +12,11 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"strconv"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -23,17 +28,50 @@ var (
 	db                         *sqlx.DB
 	chairByAuthTokenCache      = map[string]*Chair{}
 	chairByAuthTokenCacheMutex sync.RWMutex
-	rideCacheByChairID         = map[string]*Ride{}
-	rideCacheByChairIDMutex    sync.RWMutex
+	// トークンを無効化するたびに増やす。無効化の前に DB から読んだイスをキャッシュに書き戻さないため
+	chairByAuthTokenCacheGeneration uint64
+	rideCacheByChairID              = map[string]*Ride{}
+	rideCacheByChairIDMutex         sync.RWMutex
 )
 
 func main() {
+	// サブコマンド
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "reconcile":
+			os.Exit(runReconcileCommand(os.Args[2:]))
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	mux := setup()
+	srv := &http.Server{Addr: ":8080", Handler: mux}
+	srv.RegisterOnShutdown(closeNotificationStreams)
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			slog.Error("failed to shutdown server", slog.Any("error", err))
+		}
+	}()
+
 	slog.Info("Listening on :8080")
-	http.ListenAndServe(":8080", mux)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("server error", slog.Any("error", err))
+	}
+
+	shutdownBackgroundTasks()
+
+	// バッファに残っている座標を書き出してから終了する
+	if err := flushChairLocations(context.Background()); err != nil {
+		slog.Error("failed to flush chair locations", slog.Any("error", err))
+	}
 }
 
-func setup() http.Handler {
+func connectDB() *sqlx.DB {
 	host := os.Getenv("ISUCON_DB_HOST")
 	if host == "" {
 		host = "127.0.0.1"
@@ -73,7 +111,30 @@ func setup() http.Handler {
 		panic(err)
 	}
 	_db.SetMaxOpenConns(1000)
-	db = _db
+	return _db
+}
+
+func setup() http.Handler {
+	db = connectDB()
+
+	currentMatchingStrategy = getMatchingStrategy()
+	currentMovementCheckMode = getMovementCheckMode()
+	chairMoveTick = getChairMoveTick()
+	chairOfflineTimeout = getChairOfflineTimeout()
+	currentPayoutPeriod = getPayoutPeriod()
+	matcher = startPeriodicTask("matching", getMatchingInterval(), runMatching)
+	paymentWorker = startPeriodicTask("payment", paymentWorkerInterval, runPaymentWorker)
+	startPeriodicTask("coupon-expiry", couponExpiryInterval, runCouponExpiry)
+	chairLocationWriter = startPeriodicTask("chair-locations", chairLocationFlushInterval, flushChairLocations)
+	startPeriodicTask("chair-presence", chairPresenceSweepInterval, runChairPresenceSweep)
+	startPeriodicTask("payout-settlement", payoutSettlementInterval, runPayoutSettlement)
+
+	if err := loadChairIndex(context.Background()); err != nil {
+		panic(err)
+	}
+	if err := loadChairPresence(context.Background()); err != nil {
+		panic(err)
+	}
 
 	mux := chi.NewRouter()
 	mux.Use(middleware.Recoverer)
@@ -85,10 +146,13 @@ func setup() http.Handler {
 
 		authedMux := mux.With(appAuthMiddleware)
 		authedMux.HandleFunc("POST /api/app/payment-methods", appPostPaymentMethods)
+		authedMux.HandleFunc("GET /api/app/coupons", appGetCoupons)
+		authedMux.HandleFunc("GET /api/app/referrals", appGetReferrals)
 		authedMux.HandleFunc("GET /api/app/rides", appGetRides)
 		authedMux.HandleFunc("POST /api/app/rides", appPostRides)
 		authedMux.HandleFunc("POST /api/app/rides/estimated-fare", appPostRidesEstimatedFare)
 		authedMux.HandleFunc("POST /api/app/rides/{ride_id}/evaluation", appPostRideEvaluatation)
+		authedMux.HandleFunc("POST /api/app/rides/{ride_id}/cancel", appPostRideCancel)
 		authedMux.HandleFunc("GET /api/app/notification", appGetNotification)
 		authedMux.HandleFunc("GET /api/app/nearby-chairs", appGetNearbyChairs)
 	}
@@ -98,8 +162,17 @@ func setup() http.Handler {
 		mux.HandleFunc("POST /api/owner/owners", ownerPostOwners)
 
 		authedMux := mux.With(ownerAuthMiddleware)
+		authedMux.HandleFunc("POST /api/owner/chair-register-token", ownerPostChairRegisterToken)
 		authedMux.HandleFunc("GET /api/owner/sales", ownerGetSales)
+		authedMux.HandleFunc("GET /api/owner/sales/export", ownerGetSalesExport)
+		authedMux.HandleFunc("GET /api/owner/payouts", ownerGetPayouts)
 		authedMux.HandleFunc("GET /api/owner/chairs", ownerGetChairs)
+		authedMux.HandleFunc("PATCH /api/owner/chairs/{chair_id}", ownerPatchChair)
+		authedMux.HandleFunc("DELETE /api/owner/chairs/{chair_id}", ownerDeleteChair)
+		authedMux.HandleFunc("POST /api/owner/chairs/{chair_id}/access-token", ownerPostChairAccessToken)
+		authedMux.HandleFunc("DELETE /api/owner/chairs/{chair_id}/access-token", ownerDeleteChairAccessToken)
+		authedMux.HandleFunc("GET /api/owner/chairs/{chair_id}/locations", ownerGetChairLocations)
+		authedMux.HandleFunc("GET /api/owner/chairs/{chair_id}/anomalies", ownerGetChairAnomalies)
 	}
 
 	// chair handlers
@@ -109,13 +182,19 @@ func setup() http.Handler {
 		authedMux := mux.With(chairAuthMiddleware)
 		authedMux.HandleFunc("POST /api/chair/activity", chairPostActivity)
 		authedMux.HandleFunc("POST /api/chair/coordinate", chairPostCoordinate)
+		authedMux.HandleFunc("POST /api/chair/coordinates", chairPostCoordinates)
 		authedMux.HandleFunc("GET /api/chair/notification", chairGetNotification)
 		authedMux.HandleFunc("POST /api/chair/rides/{ride_id}/status", chairPostRideStatus)
+		authedMux.HandleFunc("POST /api/chair/rides/{ride_id}/decline", chairPostRideDecline)
 	}
 
 	// internal handlers
 	{
 		mux.HandleFunc("GET /api/internal/matching", internalGetMatching)
+		mux.HandleFunc("GET /api/internal/campaigns", internalGetCampaigns)
+		mux.HandleFunc("POST /api/internal/campaigns", internalPostCampaign)
+		mux.HandleFunc("GET /api/internal/chair-models", internalGetChairModels)
+		mux.HandleFunc("PATCH /api/internal/chair-models/{model}", internalPatchChairModel)
 	}
 
 	return mux
@@ -133,9 +212,20 @@ func initCache() {
 	chairByAuthTokenCacheMutex.Lock()
 	defer chairByAuthTokenCacheMutex.Unlock()
 	chairByAuthTokenCache = map[string]*Chair{}
+	chairByAuthTokenCacheGeneration++
 	rideCacheByChairIDMutex.Lock()
 	defer rideCacheByChairIDMutex.Unlock()
 	rideCacheByChairID = map[string]*Ride{}
+	resetSurgePercents()
+	resetPendingChairLocations()
+}
+
+// 認証キャッシュからトークンを消す。トークンを変えたときやイスの情報が古くなったときに呼ぶ
+func invalidateChairAuthToken(accessToken string) {
+	chairByAuthTokenCacheMutex.Lock()
+	defer chairByAuthTokenCacheMutex.Unlock()
+	delete(chairByAuthTokenCache, accessToken)
+	chairByAuthTokenCacheGeneration++
 }
 
 func postInitialize(w http.ResponseWriter, r *http.Request) {
@@ -204,7 +294,7 @@ func postInitialize(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// ライドの状態を更新
-	rows, err := db.QueryContext(ctx, "SELECT * FROM rides")
+	rows, err := db.QueryxContext(ctx, "SELECT * FROM rides")
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
@@ -213,18 +303,7 @@ func postInitialize(w http.ResponseWriter, r *http.Request) {
 	rideCacheByChairIDMutex.Lock()
 	for rows.Next() {
 		ride := &Ride{}
-		if err := rows.Scan(
-			&ride.ID,
-			&ride.UserID,
-			&ride.ChairID,
-			&ride.PickupLatitude,
-			&ride.PickupLongitude,
-			&ride.DestinationLatitude,
-			&ride.DestinationLongitude,
-			&ride.Evaluation,
-			&ride.CreatedAt,
-			&ride.UpdatedAt,
-		); err != nil {
+		if err := rows.StructScan(ride); err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
@@ -234,6 +313,21 @@ func postInitialize(w http.ResponseWriter, r *http.Request) {
 	}
 	rideCacheByChairIDMutex.Unlock()
 
+	if err := loadChairIndex(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	// 初期データのイスは最後のリクエスト日時を持たないので、初期化した時刻から数える
+	// そうしないと最初の sweep で全てのイスをオフラインにしてしまう
+	if _, err := db.ExecContext(ctx, "UPDATE chairs SET last_seen_at = CURRENT_TIMESTAMP(6) WHERE is_online = TRUE AND deleted_at IS NULL"); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := loadChairPresence(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
 	go func() {
 		if _, err := http.Get("http://localhost:9000/api/group/collect"); err != nil {
 			log.Printf("failed to request to pprotein: %v", err)
@@ -274,7 +368,7 @@ func writeError(w http.ResponseWriter, statusCode int, err error) {
 	}
 	w.Write(buf)
 
-	slog.Error("error response wrote", err)
+	slog.Error("error response wrote", slog.Any("error", err))
 }
 
 func secureRandomStr(b int) string {
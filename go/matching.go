@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const defaultMatchingInterval = 500 * time.Millisecond
+
+var (
+	matcher                 *periodicTask
+	currentMatchingStrategy matchingStrategy = greedyMatchingStrategy{}
+	// スケジューラと internalGetMatching が同時に走って二重割り当てしないようにする
+	matchingMutex sync.Mutex
+)
+
+func getMatchingInterval() time.Duration {
+	// ISUCON_MATCHING_INTERVAL は秒単位 (例: 0.5)
+	v := os.Getenv("ISUCON_MATCHING_INTERVAL")
+	if v == "" {
+		return defaultMatchingInterval
+	}
+	sec, err := strconv.ParseFloat(v, 64)
+	if err != nil || sec <= 0 {
+		slog.Warn("invalid ISUCON_MATCHING_INTERVAL, using default", slog.String("value", v))
+		return defaultMatchingInterval
+	}
+	return time.Duration(sec * float64(time.Second))
+}
+
+// 新しいライドや空きイスが出来たときに、次の tick を待たずにマッチングさせる
+func triggerMatching() {
+	matcher.trigger()
+}
+
+// 待っているライドを空いているイスに割り当てる
+func runMatching(ctx context.Context) error {
+	matchingMutex.Lock()
+	defer matchingMutex.Unlock()
+
+	// 待っているリクエストを取得
+	rides := []*Ride{}
+	if err := db.SelectContext(ctx, &rides, "SELECT * FROM rides WHERE chair_id IS NULL AND NOT EXISTS (SELECT 1 FROM ride_statuses WHERE ride_statuses.ride_id = rides.id AND ride_statuses.status = 'CANCELED') ORDER BY created_at"); err != nil {
+		return err
+	}
+	if len(rides) == 0 {
+		resetSurgePercents()
+		return nil
+	}
+
+	// 空きイスとその座標を取得
+	// 割り当てられたライドが全て完了またはキャンセルされていて、その通知をイスが受け取っていれば空き
+	freeChairs := []*Chair{}
+	if err := db.SelectContext(ctx, &freeChairs, `
+		SELECT * FROM chairs
+		WHERE is_active = TRUE
+		AND is_online = TRUE
+		AND NOT EXISTS (
+			SELECT 1 FROM rides
+			WHERE rides.chair_id = chairs.id
+			AND NOT EXISTS (
+				SELECT 1 FROM ride_statuses
+				WHERE ride_statuses.ride_id = rides.id
+				AND ride_statuses.status IN ('COMPLETED', 'CANCELED')
+				AND ride_statuses.chair_sent_at IS NOT NULL
+			)
+		)
+	`); err != nil {
+		return err
+	}
+	// 割り当て前の需要と供給からサージ倍率を決める
+	updateSurgePercents(rides, freeChairs)
+	if len(freeChairs) == 0 {
+		return nil
+	}
+
+	// イスの性能を取得
+	tmp2 := []*ChairModel{}
+	if err := db.SelectContext(ctx, &tmp2, "SELECT * FROM chair_models"); err != nil {
+		return err
+	}
+	chairModels := map[string]int{}
+	for _, model := range tmp2 {
+		chairModels[model.Name] = model.Speed
+	}
+
+	// 座標が分からない・速度が分からないイスは割り当て対象外
+	candidates := make([]*Chair, 0, len(freeChairs))
+	for _, chair := range freeChairs {
+		if !chair.LocationLat.Valid || !chair.LocationLon.Valid || chairModels[chair.Model] <= 0 {
+			continue
+		}
+		candidates = append(candidates, chair)
+	}
+
+	// マッチング
+	strategy := currentMatchingStrategy
+	pairs := strategy.match(rides, candidates, chairModels)
+
+	totalPickupTime := 0.0
+	for _, pair := range pairs {
+		// 取得後にキャンセルされたライドや、退役・非アクティブ・オフラインになったイスには割り当てない
+		// UPDATE の副問い合わせは chairs の行を共有ロックで読むので、退役のトランザクションとは入れ違わない
+		result, err := db.ExecContext(
+			ctx,
+			`UPDATE rides SET chair_id = ?
+			WHERE id = ? AND chair_id IS NULL
+			  AND NOT EXISTS (SELECT 1 FROM ride_statuses WHERE ride_statuses.ride_id = rides.id AND ride_statuses.status = 'CANCELED')
+			  AND EXISTS (SELECT 1 FROM chairs WHERE chairs.id = ? AND chairs.deleted_at IS NULL AND chairs.is_active = TRUE AND chairs.is_online = TRUE)`,
+			pair.chair.ID, pair.ride.ID, pair.chair.ID,
+		)
+		if err != nil {
+			return err
+		}
+		if count, err := result.RowsAffected(); err != nil {
+			return err
+		} else if count == 0 {
+			continue
+		}
+		pair.ride.ChairID = sql.NullString{String: pair.chair.ID, Valid: true}
+		notifyRideStatus(pair.ride)
+		rideCacheByChairIDMutex.Lock()
+		rideCacheByChairID[pair.chair.ID] = pair.ride
+		rideCacheByChairIDMutex.Unlock()
+		chairIndex.setBusy(pair.chair.ID, true)
+		invalidateChairAuthToken(pair.chair.AccessToken)
+
+		totalPickupTime += pickupTime(pair.ride, pair.chair, chairModels[pair.chair.Model])
+	}
+
+	// 戦略ごとの比較用
+	if len(pairs) > 0 {
+		slog.Info("matched",
+			slog.String("strategy", strategy.name()),
+			slog.Int("rides", len(rides)),
+			slog.Int("chairs", len(candidates)),
+			slog.Int("matched", len(pairs)),
+			slog.Float64("avg_pickup_time", totalPickupTime/float64(len(pairs))),
+		)
+	}
+
+	return nil
+}
+
+// unassignRide はライドからイスの割り当てを外してマッチング待ちに戻す
+// まだ ENROUTE を送っていなければ状態は MATCHING のまま、割り当てだけを外す
+func unassignRide(ctx context.Context, tx *sqlx.Tx, ride *Ride, status string) error {
+	if status != rideStatusMatching {
+		if err := transitRideStatus(ctx, tx, ride.ID, rideStatusMatching); err != nil {
+			return err
+		}
+	}
+	_, err := tx.ExecContext(ctx, "UPDATE rides SET chair_id = NULL, trace_started_at = NULL WHERE id = ?", ride.ID)
+	return err
+}
+
+// rematchRide は unassignRide をコミットした後に、キャッシュを更新して再マッチングさせる
+func rematchRide(chairID string, ride *Ride) {
+	rideCacheByChairIDMutex.Lock()
+	if cached, ok := rideCacheByChairID[chairID]; ok && cached.ID == ride.ID {
+		delete(rideCacheByChairID, chairID)
+	}
+	rideCacheByChairIDMutex.Unlock()
+	chairIndex.setBusy(chairID, false)
+
+	ride.ChairID = sql.NullString{}
+	notifyRideStatus(ride)
+	triggerMatching()
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"os"
+	"sort"
+)
+
+type matchingPair struct {
+	ride  *Ride
+	chair *Chair
+}
+
+// matchingStrategy は待っているライドと空きイスの組み合わせを決める
+// chairs には座標が分かっていて、速度が speeds に載っているイスだけが渡される
+type matchingStrategy interface {
+	name() string
+	match(rides []*Ride, chairs []*Chair, speeds map[string]int) []matchingPair
+}
+
+// ISUCON_MATCHING_STRATEGY で切り替える (greedy / optimal)
+func getMatchingStrategy() matchingStrategy {
+	switch v := os.Getenv("ISUCON_MATCHING_STRATEGY"); v {
+	case "", "greedy":
+		return greedyMatchingStrategy{}
+	case "optimal":
+		return optimalMatchingStrategy{}
+	default:
+		slog.Warn("unknown ISUCON_MATCHING_STRATEGY, using greedy", slog.String("value", v))
+		return greedyMatchingStrategy{}
+	}
+}
+
+// イスがライドを配車位置で拾って目的地まで運ぶまでのコスト
+func matchingCost(ride *Ride, chair *Chair, speed int) float64 {
+	pickupDist := calculateDistance(int(chair.LocationLat.Int32), int(chair.LocationLon.Int32), ride.PickupLatitude, ride.PickupLongitude)
+	moveDist := calculateDistance(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+	return float64(pickupDist+moveDist*10) / float64(speed)
+}
+
+// イスが配車位置に着くまでの時間
+func pickupTime(ride *Ride, chair *Chair, speed int) float64 {
+	pickupDist := calculateDistance(int(chair.LocationLat.Int32), int(chair.LocationLon.Int32), ride.PickupLatitude, ride.PickupLongitude)
+	return float64(pickupDist) / float64(speed)
+}
+
+// greedyMatchingStrategy は移動距離の長いライドから順に、コストが最小のイスを割り当てる
+type greedyMatchingStrategy struct{}
+
+func (greedyMatchingStrategy) name() string { return "greedy" }
+
+func (greedyMatchingStrategy) match(rides []*Ride, chairs []*Chair, speeds map[string]int) []matchingPair {
+	sort.Slice(rides, func(i, j int) bool {
+		iDist := calculateDistance(rides[i].PickupLatitude, rides[i].PickupLongitude, rides[i].DestinationLatitude, rides[i].DestinationLongitude)
+		jDist := calculateDistance(rides[j].PickupLatitude, rides[j].PickupLongitude, rides[j].DestinationLatitude, rides[j].DestinationLongitude)
+		return iDist > jDist
+	})
+	isChairUsed := make([]bool, len(chairs))
+
+	pairs := []matchingPair{}
+	for _, ride := range rides {
+		bestChairIdx := -1
+		bestTime := 1e9
+
+		for chairIdx, chair := range chairs {
+			if isChairUsed[chairIdx] {
+				continue
+			}
+			time := matchingCost(ride, chair, speeds[chair.Model])
+			if time < bestTime {
+				bestTime = time
+				bestChairIdx = chairIdx
+			}
+		}
+
+		if bestChairIdx == -1 {
+			continue
+		}
+
+		isChairUsed[bestChairIdx] = true
+		pairs = append(pairs, matchingPair{ride: ride, chair: chairs[bestChairIdx]})
+	}
+	return pairs
+}
+
+// optimalMatchingStrategy は割り当て数を最大にしたうえで、コストの合計が最小になる組み合わせをハンガリアン法で求める
+type optimalMatchingStrategy struct{}
+
+func (optimalMatchingStrategy) name() string { return "optimal" }
+
+func (optimalMatchingStrategy) match(rides []*Ride, chairs []*Chair, speeds map[string]int) []matchingPair {
+	if len(rides) == 0 || len(chairs) == 0 {
+		return []matchingPair{}
+	}
+
+	// 行数 <= 列数 になるように向きを決める
+	transposed := len(rides) > len(chairs)
+	n, m := len(rides), len(chairs)
+	if transposed {
+		n, m = m, n
+	}
+	cost := make([][]float64, n)
+	for i := range cost {
+		cost[i] = make([]float64, m)
+		for j := range cost[i] {
+			rideIdx, chairIdx := i, j
+			if transposed {
+				rideIdx, chairIdx = j, i
+			}
+			ride, chair := rides[rideIdx], chairs[chairIdx]
+			cost[i][j] = matchingCost(ride, chair, speeds[chair.Model])
+		}
+	}
+
+	assignment := hungarian(cost)
+
+	pairs := make([]matchingPair, 0, n)
+	for i, j := range assignment {
+		if transposed {
+			pairs = append(pairs, matchingPair{ride: rides[j], chair: chairs[i]})
+		} else {
+			pairs = append(pairs, matchingPair{ride: rides[i], chair: chairs[j]})
+		}
+	}
+	return pairs
+}
+
+// hungarian は n <= m の n x m コスト行列について、各行に相異なる列を割り当てて合計コストを最小にする
+// 戻り値は行 i に割り当てられた列のインデックス
+func hungarian(cost [][]float64) []int {
+	n := len(cost)
+	m := len(cost[0])
+
+	// 1-indexed で扱う
+	u := make([]float64, n+1)
+	v := make([]float64, m+1)
+	p := make([]int, m+1) // p[j]: 列 j に割り当てられた行
+	way := make([]int, m+1)
+
+	for i := 1; i <= n; i++ {
+		p[0] = i
+		j0 := 0
+		minv := make([]float64, m+1)
+		used := make([]bool, m+1)
+		for j := range minv {
+			minv[j] = math.Inf(1)
+		}
+		for {
+			used[j0] = true
+			i0 := p[j0]
+			delta := math.Inf(1)
+			j1 := 0
+			for j := 1; j <= m; j++ {
+				if used[j] {
+					continue
+				}
+				cur := cost[i0-1][j-1] - u[i0] - v[j]
+				if cur < minv[j] {
+					minv[j] = cur
+					way[j] = j0
+				}
+				if minv[j] < delta {
+					delta = minv[j]
+					j1 = j
+				}
+			}
+			for j := 0; j <= m; j++ {
+				if used[j] {
+					u[p[j]] += delta
+					v[j] -= delta
+				} else {
+					minv[j] -= delta
+				}
+			}
+			j0 = j1
+			if p[j0] == 0 {
+				break
+			}
+		}
+		for j0 != 0 {
+			j1 := way[j0]
+			p[j0] = p[j1]
+			j0 = j1
+		}
+	}
+
+	assignment := make([]int, n)
+	for j := 1; j <= m; j++ {
+		if p[j] != 0 {
+			assignment[p[j]-1] = j - 1
+		}
+	}
+	return assignment
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"testing"
+)
+
+// bruteForceAssignment は n <= m の行列について、各行に相異なる列を割り当てる全通りから最小コストを求める
+func bruteForceAssignment(cost [][]float64) float64 {
+	n, m := len(cost), len(cost[0])
+	used := make([]bool, m)
+	best := math.Inf(1)
+	var dfs func(i int, sum float64)
+	dfs = func(i int, sum float64) {
+		if i == n {
+			best = min(best, sum)
+			return
+		}
+		for j := 0; j < m; j++ {
+			if used[j] {
+				continue
+			}
+			used[j] = true
+			dfs(i+1, sum+cost[i][j])
+			used[j] = false
+		}
+	}
+	dfs(0, 0)
+	return best
+}
+
+func TestHungarianMatchesBruteForce(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 1))
+	for round := 0; round < 300; round++ {
+		n := 1 + rng.IntN(5)
+		m := n + rng.IntN(3)
+		cost := make([][]float64, n)
+		for i := range cost {
+			cost[i] = make([]float64, m)
+			for j := range cost[i] {
+				// 同じコストが出やすいように整数にする
+				cost[i][j] = float64(rng.IntN(20))
+			}
+		}
+
+		assignment := hungarian(cost)
+		if len(assignment) != n {
+			t.Fatalf("hungarian(%v) returned %d rows, want %d", cost, len(assignment), n)
+		}
+		seen := map[int]bool{}
+		got := 0.0
+		for i, j := range assignment {
+			if j < 0 || j >= m || seen[j] {
+				t.Fatalf("hungarian(%v) = %v, not a valid assignment", cost, assignment)
+			}
+			seen[j] = true
+			got += cost[i][j]
+		}
+		if want := bruteForceAssignment(cost); math.Abs(got-want) > 1e-9 {
+			t.Fatalf("hungarian(%v) = %v with cost %v, want %v", cost, assignment, got, want)
+		}
+	}
+}
+
+func TestOptimalMatchingStrategy(t *testing.T) {
+	tests := []struct {
+		rides  int
+		chairs int
+	}{
+		{0, 3},
+		{3, 0},
+		{2, 5},
+		{5, 2},
+		{4, 4},
+	}
+	rng := rand.New(rand.NewPCG(2, 2))
+	speeds := map[string]int{"slow": 2, "fast": 5}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("rides=%d,chairs=%d", tt.rides, tt.chairs), func(t *testing.T) {
+			rides := make([]*Ride, tt.rides)
+			for i := range rides {
+				rides[i] = &Ride{
+					ID:                   fmt.Sprintf("ride-%d", i),
+					PickupLatitude:       rng.IntN(100),
+					PickupLongitude:      rng.IntN(100),
+					DestinationLatitude:  rng.IntN(100),
+					DestinationLongitude: rng.IntN(100),
+				}
+			}
+			chairs := make([]*Chair, tt.chairs)
+			for i := range chairs {
+				model := "slow"
+				if i%2 == 0 {
+					model = "fast"
+				}
+				chairs[i] = &Chair{
+					ID:          fmt.Sprintf("chair-%d", i),
+					Model:       model,
+					LocationLat: sql.NullInt32{Int32: int32(rng.IntN(100)), Valid: true},
+					LocationLon: sql.NullInt32{Int32: int32(rng.IntN(100)), Valid: true},
+				}
+			}
+
+			pairs := optimalMatchingStrategy{}.match(rides, chairs, speeds)
+			if want := min(tt.rides, tt.chairs); len(pairs) != want {
+				t.Fatalf("got %d pairs, want %d", len(pairs), want)
+			}
+			usedRides, usedChairs := map[string]bool{}, map[string]bool{}
+			for _, pair := range pairs {
+				if usedRides[pair.ride.ID] || usedChairs[pair.chair.ID] {
+					t.Fatalf("ride %s or chair %s is assigned twice", pair.ride.ID, pair.chair.ID)
+				}
+				usedRides[pair.ride.ID] = true
+				usedChairs[pair.chair.ID] = true
+			}
+
+			// greedy より悪くならない
+			total := func(pairs []matchingPair) float64 {
+				sum := 0.0
+				for _, pair := range pairs {
+					sum += matchingCost(pair.ride, pair.chair, speeds[pair.chair.Model])
+				}
+				return sum
+			}
+			greedy := greedyMatchingStrategy{}.match(append([]*Ride{}, rides...), chairs, speeds)
+			if len(greedy) == len(pairs) && total(pairs) > total(greedy)+1e-9 {
+				t.Fatalf("optimal cost %v is worse than greedy %v", total(pairs), total(greedy))
+			}
+		})
+	}
+}
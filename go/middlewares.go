@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"log/slog"
 	"net/http"
 )
 
@@ -67,15 +68,17 @@ func chairAuthMiddleware(next http.Handler) http.Handler {
 		accessToken := c.Value
 		chairByAuthTokenCacheMutex.RLock()
 		cached, ok := chairByAuthTokenCache[accessToken]
+		generation := chairByAuthTokenCacheGeneration
 		chairByAuthTokenCacheMutex.RUnlock()
 		if ok {
+			touchChairOrLog(ctx, cached.ID)
 			ctx = context.WithValue(ctx, "chair", cached)
 			next.ServeHTTP(w, r.WithContext(ctx))
 			return
 		}
 
 		chair := &Chair{}
-		err = db.GetContext(ctx, chair, "SELECT * FROM chairs WHERE access_token = ?", accessToken)
+		err = db.GetContext(ctx, chair, "SELECT * FROM chairs WHERE access_token = ? AND deleted_at IS NULL", accessToken)
 		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
 				writeError(w, http.StatusUnauthorized, errors.New("invalid access token"))
@@ -86,10 +89,22 @@ func chairAuthMiddleware(next http.Handler) http.Handler {
 		}
 
 		chairByAuthTokenCacheMutex.Lock()
-		chairByAuthTokenCache[accessToken] = chair
+		// 読んでいる間に無効化されたなら、そのトークンはもう使えないかもしれない
+		if generation == chairByAuthTokenCacheGeneration {
+			chairByAuthTokenCache[accessToken] = chair
+		}
 		chairByAuthTokenCacheMutex.Unlock()
 
+		touchChairOrLog(ctx, chair.ID)
+
 		ctx = context.WithValue(ctx, "chair", chair)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// 最終アクセス時刻の更新に失敗してもリクエストは処理する
+func touchChairOrLog(ctx context.Context, chairID string) {
+	if err := touchChair(ctx, chairID); err != nil {
+		slog.Error("failed to mark chair online", slog.String("chair_id", chairID), slog.Any("error", err))
+	}
+}
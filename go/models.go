@@ -16,13 +16,17 @@ type Chair struct {
 	LocationLon            sql.NullInt32 `db:"location_lon"`
 	TotalDistance          int           `db:"total_distance"`
 	TotalDistanceUpdatedAt sql.NullTime  `db:"total_distance_updated_at"`
+	IsOnline               bool          `db:"is_online"`
+	LastSeenAt             sql.NullTime  `db:"last_seen_at"`
+	DeletedAt              sql.NullTime  `db:"deleted_at"`
 	CreatedAt              time.Time     `db:"created_at"`
 	UpdatedAt              time.Time     `db:"updated_at"`
 }
 
 type ChairModel struct {
-	Name  string `db:"name"`
-	Speed int    `db:"speed"`
+	Name              string `db:"name"`
+	Speed             int    `db:"speed"`
+	CommissionPercent int    `db:"commission_percent"`
 }
 
 type ChairLocation struct {
@@ -33,6 +37,20 @@ type ChairLocation struct {
 	CreatedAt time.Time `db:"created_at"`
 }
 
+type ChairMovementAnomaly struct {
+	ID            string    `db:"id"`
+	ChairID       string    `db:"chair_id"`
+	FromLatitude  int       `db:"from_latitude"`
+	FromLongitude int       `db:"from_longitude"`
+	ToLatitude    int       `db:"to_latitude"`
+	ToLongitude   int       `db:"to_longitude"`
+	Distance      int       `db:"distance"`
+	ElapsedMs     int64     `db:"elapsed_ms"`
+	MaxDistance   int       `db:"max_distance"`
+	Action        string    `db:"action"`
+	CreatedAt     time.Time `db:"created_at"`
+}
+
 type User struct {
 	ID             string    `db:"id"`
 	Username       string    `db:"username"`
@@ -60,6 +78,14 @@ type Ride struct {
 	DestinationLatitude  int            `db:"destination_latitude"`
 	DestinationLongitude int            `db:"destination_longitude"`
 	Evaluation           *int           `db:"evaluation"`
+	SurgePercent         int            `db:"surge_percent"`
+	BaseFare             int            `db:"base_fare"`
+	MeteredFare          int            `db:"metered_fare"`
+	SurgeFare            int            `db:"surge_fare"`
+	Discount             int            `db:"discount"`
+	TotalFare            int            `db:"total_fare"`
+	TraceStartedAt       sql.NullTime   `db:"trace_started_at"`
+	TraceEndedAt         sql.NullTime   `db:"trace_ended_at"`
 	CreatedAt            time.Time      `db:"created_at"`
 	UpdatedAt            time.Time      `db:"updated_at"`
 }
@@ -83,9 +109,68 @@ type Owner struct {
 }
 
 type Coupon struct {
-	UserID    string    `db:"user_id"`
-	Code      string    `db:"code"`
-	Discount  int       `db:"discount"`
-	CreatedAt time.Time `db:"created_at"`
-	UsedBy    *string   `db:"used_by"`
+	UserID          string     `db:"user_id"`
+	Code            string     `db:"code"`
+	CampaignID      *string    `db:"campaign_id"`
+	Discount        int        `db:"discount"`
+	DiscountPercent *int       `db:"discount_percent"`
+	CreatedAt       time.Time  `db:"created_at"`
+	ExpiresAt       *time.Time `db:"expires_at"`
+	IsExpired       bool       `db:"is_expired"`
+	UsedBy          *string    `db:"used_by"`
+}
+
+type Campaign struct {
+	ID                string     `db:"id"`
+	Name              string     `db:"name"`
+	GrantOn           string     `db:"grant_on"`
+	Code              string     `db:"code"`
+	DiscountType      string     `db:"discount_type"`
+	DiscountAmount    int        `db:"discount_amount"`
+	DiscountPercent   *int       `db:"discount_percent"`
+	PerUserLimit      *int       `db:"per_user_limit"`
+	PerCodeLimit      *int       `db:"per_code_limit"`
+	ValidDays         *int       `db:"valid_days"`
+	FirstRidePriority bool       `db:"first_ride_priority"`
+	StartsAt          *time.Time `db:"starts_at"`
+	EndsAt            *time.Time `db:"ends_at"`
+	CreatedAt         time.Time  `db:"created_at"`
+}
+
+type Payment struct {
+	RideID         string    `db:"ride_id"`
+	UserID         string    `db:"user_id"`
+	Amount         int       `db:"amount"`
+	IdempotencyKey string    `db:"idempotency_key"`
+	Status         string    `db:"status"`
+	Attempts       int       `db:"attempts"`
+	NextAttemptAt  time.Time `db:"next_attempt_at"`
+	LastError      *string   `db:"last_error"`
+	CreatedAt      time.Time `db:"created_at"`
+	UpdatedAt      time.Time `db:"updated_at"`
+}
+
+type LedgerEntry struct {
+	RideID        string         `db:"ride_id"`
+	EntryType     string         `db:"entry_type"`
+	OwnerID       string         `db:"owner_id"`
+	DebitAccount  string         `db:"debit_account"`
+	CreditAccount string         `db:"credit_account"`
+	Amount        int            `db:"amount"`
+	StatementID   sql.NullString `db:"statement_id"`
+	CreatedAt     time.Time      `db:"created_at"`
+}
+
+type PayoutStatement struct {
+	ID            string    `db:"id"`
+	OwnerID       string    `db:"owner_id"`
+	PeriodStart   time.Time `db:"period_start"`
+	PeriodEnd     time.Time `db:"period_end"`
+	Rides         int       `db:"rides"`
+	RiderCharges  int       `db:"rider_charges"`
+	CouponSubsidy int       `db:"coupon_subsidy"`
+	PlatformFee   int       `db:"platform_fee"`
+	OwnerEarnings int       `db:"owner_earnings"`
+	CreatedAt     time.Time `db:"created_at"`
+	UpdatedAt     time.Time `db:"updated_at"`
 }
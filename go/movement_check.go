@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+// 移動のもっともらしさをチェックしたときの扱い
+const (
+	// チェックしない
+	movementCheckOff = "off"
+	// 異常として記録し、その区間の移動距離は total_distance に足さない。座標自体は受け付ける
+	movementCheckFlag = "flag"
+	// 異常として記録し、座標の送信ごと拒否する
+	movementCheckReject = "reject"
+)
+
+const (
+	// イスは tick ごとに chair_models.speed だけ動ける
+	defaultChairMoveTick = 30 * time.Millisecond
+	// 送信の遅れなどを見込んで、理論上の最大距離にこれだけ余裕をもたせる
+	movementToleranceTicks   = 1
+	movementTolerancePercent = 150
+)
+
+var (
+	currentMovementCheckMode = movementCheckFlag
+	chairMoveTick            = defaultChairMoveTick
+)
+
+// chair_movement_anomalies.action
+const (
+	chairMovementAnomalyFlagged  = "FLAGGED"
+	chairMovementAnomalyRejected = "REJECTED"
+)
+
+var errImplausibleMovement = errors.New("implausible chair movement")
+
+func getMovementCheckMode() string {
+	// ISUCON_MOVEMENT_CHECK は off / flag / reject
+	switch v := os.Getenv("ISUCON_MOVEMENT_CHECK"); v {
+	case "":
+		return movementCheckFlag
+	case movementCheckOff, movementCheckFlag, movementCheckReject:
+		return v
+	default:
+		slog.Warn("unknown ISUCON_MOVEMENT_CHECK, using flag", slog.String("value", v))
+		return movementCheckFlag
+	}
+}
+
+func getChairMoveTick() time.Duration {
+	// ISUCON_CHAIR_MOVE_TICK は秒単位 (例: 0.03)
+	v := os.Getenv("ISUCON_CHAIR_MOVE_TICK")
+	if v == "" {
+		return defaultChairMoveTick
+	}
+	sec, err := strconv.ParseFloat(v, 64)
+	if err != nil || sec <= 0 {
+		slog.Warn("invalid ISUCON_CHAIR_MOVE_TICK, using default", slog.String("value", v))
+		return defaultChairMoveTick
+	}
+	return time.Duration(sec * float64(time.Second))
+}
+
+// elapsed の間に speed のイスが動ける最大の距離
+func maxPlausibleDistance(speed int, elapsed time.Duration) int {
+	ticks := int(max(elapsed, 0)/chairMoveTick) + movementToleranceTicks
+	return speed * ticks * movementTolerancePercent / 100
+}
+
+// イスのモデルの速度。モデルが見つからない場合は 0 を返し、チェックしない
+func getChairSpeed(ctx context.Context, tx *sqlx.Tx, model string) (int, error) {
+	speeds := []int{}
+	if err := tx.SelectContext(ctx, &speeds, "SELECT speed FROM chair_models WHERE name = ?", model); err != nil {
+		return 0, err
+	}
+	if len(speeds) == 0 {
+		return 0, nil
+	}
+	return speeds[0], nil
+}
+
+func newChairMovementAnomaly(chairID string, from Coordinate, to chairCoordinatePoint, distance int, elapsed time.Duration, maxDistance int) ChairMovementAnomaly {
+	action := chairMovementAnomalyFlagged
+	if currentMovementCheckMode == movementCheckReject {
+		action = chairMovementAnomalyRejected
+	}
+	return ChairMovementAnomaly{
+		ID:            ulid.Make().String(),
+		ChairID:       chairID,
+		FromLatitude:  from.Latitude,
+		FromLongitude: from.Longitude,
+		ToLatitude:    to.Latitude,
+		ToLongitude:   to.Longitude,
+		Distance:      distance,
+		ElapsedMs:     elapsed.Milliseconds(),
+		MaxDistance:   maxDistance,
+		Action:        action,
+		CreatedAt:     to.recordedAt,
+	}
+}
+
+func insertChairMovementAnomalies(ctx context.Context, execer sqlx.ExtContext, anomalies []ChairMovementAnomaly) error {
+	if len(anomalies) == 0 {
+		return nil
+	}
+	_, err := sqlx.NamedExecContext(
+		ctx,
+		execer,
+		`INSERT INTO chair_movement_anomalies (id, chair_id, from_latitude, from_longitude, to_latitude, to_longitude, distance, elapsed_ms, max_distance, action, created_at)
+		VALUES (:id, :chair_id, :from_latitude, :from_longitude, :to_latitude, :to_longitude, :distance, :elapsed_ms, :max_distance, :action, :created_at)`,
+		anomalies,
+	)
+	return err
+}
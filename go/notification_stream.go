@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const notificationStreamKeepAliveInterval = 15 * time.Second
+
+// サーバーの終了時に閉じる。開いている通知ストリームを切断して Shutdown を待たせないため
+var notificationStreamsClosing = make(chan struct{})
+
+func closeNotificationStreams() {
+	close(notificationStreamsClosing)
+}
+
+// Accept: text/event-stream のときは SSE で通知を返す。それ以外は従来のポーリング用 JSON
+func acceptsEventStream(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// notificationCursor は最後に送ったライドステータスの位置
+// 再接続時は Last-Event-ID (ride_statuses.id) から復元する
+type notificationCursor struct {
+	rideID    string
+	createdAt time.Time
+}
+
+func restoreNotificationCursor(ctx context.Context, r *http.Request) (*notificationCursor, error) {
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		return nil, nil
+	}
+	status := &RideStatus{}
+	if err := db.GetContext(ctx, status, `SELECT * FROM ride_statuses WHERE id = ?`, lastEventID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &notificationCursor{rideID: status.RideID, createdAt: status.CreatedAt}, nil
+}
+
+// 送るべきライドステータスを古い順に返す
+// カーソルが無い (初回接続) ときは未送信のものを、全て送信済みなら最新の状態だけを返す
+// カーソルが別のライドを指しているとき (新しいライドに切り替わった、辞退で前のライドに戻ったなど) は未送信のものだけを返す
+func selectRideStatusesToPush(ctx context.Context, tx *sqlx.Tx, rideID string, cursor *notificationCursor, sentAtColumn string) ([]RideStatus, error) {
+	statuses := []RideStatus{}
+	if cursor == nil {
+		if err := tx.SelectContext(ctx, &statuses, `SELECT * FROM ride_statuses WHERE ride_id = ? AND `+sentAtColumn+` IS NULL ORDER BY created_at ASC`, rideID); err != nil {
+			return nil, err
+		}
+		if len(statuses) > 0 {
+			return statuses, nil
+		}
+		if err := tx.SelectContext(ctx, &statuses, `SELECT * FROM ride_statuses WHERE ride_id = ? ORDER BY created_at DESC LIMIT 1`, rideID); err != nil {
+			return nil, err
+		}
+		return statuses, nil
+	}
+
+	if cursor.rideID != rideID {
+		if err := tx.SelectContext(ctx, &statuses, `SELECT * FROM ride_statuses WHERE ride_id = ? AND `+sentAtColumn+` IS NULL ORDER BY created_at ASC`, rideID); err != nil {
+			return nil, err
+		}
+		return statuses, nil
+	}
+	if err := tx.SelectContext(ctx, &statuses, `SELECT * FROM ride_statuses WHERE ride_id = ? AND created_at > ? ORDER BY created_at ASC`, rideID, cursor.createdAt); err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+// notificationEvent はトランザクションをコミットしてから送るイベント。id は ride_statuses.id
+type notificationEvent struct {
+	id     string
+	data   interface{}
+	cursor *notificationCursor
+}
+
+// 遅いクライアントにロックを握らせないよう、イベントはコミットした後に書き出す
+// 送信済みの印は書き出しと flush に成功してから付ける。失敗したものは再接続したときに送り直す
+func writeNotificationEvents(ctx context.Context, stream *eventStreamWriter, events []notificationEvent, cursor *notificationCursor, sentAtColumn string) (*notificationCursor, error) {
+	for _, event := range events {
+		if err := stream.writeEvent(event.id, event.data); err != nil {
+			return cursor, err
+		}
+		if _, err := db.ExecContext(ctx, `UPDATE ride_statuses SET `+sentAtColumn+` = CURRENT_TIMESTAMP(6) WHERE id = ? AND `+sentAtColumn+` IS NULL`, event.id); err != nil {
+			return cursor, err
+		}
+		cursor = event.cursor
+	}
+	return cursor, nil
+}
+
+type eventStreamWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func newEventStreamWriter(w http.ResponseWriter) (*eventStreamWriter, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, errors.New("streaming unsupported")
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// nginx にバッファリングさせない
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	return &eventStreamWriter{w: w, flusher: flusher}, nil
+}
+
+func (s *eventStreamWriter) writeEvent(id string, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(s.w, "id: %s\ndata: %s\n\n", id, buf); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+func (s *eventStreamWriter) keepAlive() error {
+	if _, err := fmt.Fprint(s.w, ": keep-alive\n\n"); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+// serveNotificationStream は wakeup で起こされるたびに push を呼んで新しいライドステータスを送る
+func serveNotificationStream(w http.ResponseWriter, r *http.Request, wakeup <-chan struct{}, push func(ctx context.Context, stream *eventStreamWriter, cursor *notificationCursor) (*notificationCursor, error)) {
+	ctx := r.Context()
+
+	cursor, err := restoreNotificationCursor(ctx, r)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	stream, err := newEventStreamWriter(w)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	keepAlive := time.NewTicker(notificationStreamKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		cursor, err = push(ctx, stream, cursor)
+		if err != nil {
+			// ヘッダーは送信済みなので、切断してクライアントに再接続させる
+			if ctx.Err() == nil && !errors.Is(err, errChairAccessTokenRevoked) {
+				slog.Error("notification stream aborted", slog.Any("error", err))
+			}
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-notificationStreamsClosing:
+			return
+		case <-wakeup:
+		case <-keepAlive.C:
+			if err := stream.keepAlive(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func appGetNotificationStream(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+
+	wakeup, unsubscribe := appNotifier.subscribe(user.ID)
+	defer unsubscribe()
+
+	serveNotificationStream(w, r, wakeup, func(ctx context.Context, stream *eventStreamWriter, cursor *notificationCursor) (*notificationCursor, error) {
+		tx, err := db.Beginx()
+		if err != nil {
+			return cursor, err
+		}
+		defer tx.Rollback()
+
+		ride := &Ride{}
+		if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE user_id = ? ORDER BY created_at DESC LIMIT 1`, user.ID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return cursor, nil
+			}
+			return cursor, err
+		}
+
+		statuses, err := selectRideStatusesToPush(ctx, tx, ride.ID, cursor, "app_sent_at")
+		if err != nil {
+			return cursor, err
+		}
+		events := make([]notificationEvent, 0, len(statuses))
+		for _, status := range statuses {
+			data, err := buildAppNotificationData(ctx, tx, ride, status.Status)
+			if err != nil {
+				return cursor, err
+			}
+			events = append(events, notificationEvent{
+				id:     status.ID,
+				data:   data,
+				cursor: &notificationCursor{rideID: ride.ID, createdAt: status.CreatedAt},
+			})
+		}
+		if err := tx.Commit(); err != nil {
+			return cursor, err
+		}
+
+		return writeNotificationEvents(ctx, stream, events, cursor, "app_sent_at")
+	})
+}
+
+// 接続中にアクセストークンが変わった、あるいはイスが退役した
+var errChairAccessTokenRevoked = errors.New("chair access token has been revoked")
+
+func chairGetNotificationStream(w http.ResponseWriter, r *http.Request) {
+	chair := r.Context().Value("chair").(*Chair)
+
+	wakeup, unsubscribe := chairNotifier.subscribe(chair.ID)
+	defer unsubscribe()
+
+	serveNotificationStream(w, r, wakeup, func(ctx context.Context, stream *eventStreamWriter, cursor *notificationCursor) (*notificationCursor, error) {
+		tx, err := db.Beginx()
+		if err != nil {
+			return cursor, err
+		}
+		defer tx.Rollback()
+
+		var valid int
+		if err := tx.GetContext(ctx, &valid, `SELECT COUNT(*) FROM chairs WHERE id = ? AND access_token = ? AND deleted_at IS NULL`, chair.ID, chair.AccessToken); err != nil {
+			return cursor, err
+		}
+		if valid == 0 {
+			return cursor, errChairAccessTokenRevoked
+		}
+
+		ride := &Ride{}
+		if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE chair_id = ? ORDER BY updated_at DESC LIMIT 1`, chair.ID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return cursor, nil
+			}
+			return cursor, err
+		}
+
+		statuses, err := selectRideStatusesToPush(ctx, tx, ride.ID, cursor, "chair_sent_at")
+		if err != nil {
+			return cursor, err
+		}
+		events := make([]notificationEvent, 0, len(statuses))
+		for _, status := range statuses {
+			data, err := buildChairNotificationData(ctx, tx, ride, status.Status)
+			if err != nil {
+				return cursor, err
+			}
+			events = append(events, notificationEvent{
+				id:     status.ID,
+				data:   data,
+				cursor: &notificationCursor{rideID: ride.ID, createdAt: status.CreatedAt},
+			})
+		}
+		if err := tx.Commit(); err != nil {
+			return cursor, err
+		}
+
+		return writeNotificationEvents(ctx, stream, events, cursor, "chair_sent_at")
+	})
+}
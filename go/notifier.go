@@ -0,0 +1,62 @@
+package main
+
+import "sync"
+
+// rideStatusNotifier は ride_statuses に行が追加されたことを、SSE で待っている接続に知らせる
+// キーはユーザーIDまたはイスID
+type rideStatusNotifier struct {
+	mu   sync.Mutex
+	subs map[string]map[chan struct{}]struct{}
+}
+
+var (
+	appNotifier   = newRideStatusNotifier()
+	chairNotifier = newRideStatusNotifier()
+)
+
+func newRideStatusNotifier() *rideStatusNotifier {
+	return &rideStatusNotifier{
+		subs: map[string]map[chan struct{}]struct{}{},
+	}
+}
+
+func (n *rideStatusNotifier) subscribe(key string) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+
+	n.mu.Lock()
+	if n.subs[key] == nil {
+		n.subs[key] = map[chan struct{}]struct{}{}
+	}
+	n.subs[key][ch] = struct{}{}
+	n.mu.Unlock()
+
+	return ch, func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		delete(n.subs[key], ch)
+		if len(n.subs[key]) == 0 {
+			delete(n.subs, key)
+		}
+	}
+}
+
+// notify は待っている接続を起こす。取りこぼしても次の起床時にまとめて送られるので、詰まっていれば捨てる
+func (n *rideStatusNotifier) notify(key string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for ch := range n.subs[key] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// ライドの状態が変わったことをユーザーと割り当て済みのイスに知らせる
+// トランザクションのコミット後に呼ぶこと
+func notifyRideStatus(ride *Ride) {
+	appNotifier.notify(ride.UserID)
+	if ride.ChairID.Valid {
+		chairNotifier.notify(ride.ChairID.String)
+	}
+}
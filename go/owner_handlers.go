@@ -1,10 +1,16 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"errors"
+	"fmt"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/oklog/ulid/v2"
@@ -62,15 +68,18 @@ func ownerPostOwners(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// series は group_by を指定したときだけ返す
 type chairSales struct {
-	ID    string `json:"id"`
-	Name  string `json:"name"`
-	Sales int    `json:"sales"`
+	ID     string        `json:"id"`
+	Name   string        `json:"name"`
+	Sales  int           `json:"sales"`
+	Series []salesBucket `json:"series,omitempty"`
 }
 
 type modelSales struct {
-	Model string `json:"model"`
-	Sales int    `json:"sales"`
+	Model  string        `json:"model"`
+	Sales  int           `json:"sales"`
+	Series []salesBucket `json:"series,omitempty"`
 }
 
 type ownerGetSalesResponse struct {
@@ -79,26 +88,39 @@ type ownerGetSalesResponse struct {
 	Models     []modelSales `json:"models"`
 }
 
-func ownerGetSales(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
+// クエリパラメータの since, until (UNIXミリ秒) を読む。省略された場合は期間の制限なし
+func parseSinceUntil(r *http.Request) (time.Time, time.Time, error) {
 	since := time.Unix(0, 0)
 	until := time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
 	if r.URL.Query().Get("since") != "" {
 		parsed, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
 		if err != nil {
-			writeError(w, http.StatusBadRequest, err)
-			return
+			return since, until, err
 		}
 		since = time.UnixMilli(parsed)
 	}
 	if r.URL.Query().Get("until") != "" {
 		parsed, err := strconv.ParseInt(r.URL.Query().Get("until"), 10, 64)
 		if err != nil {
-			writeError(w, http.StatusBadRequest, err)
-			return
+			return since, until, err
 		}
 		until = time.UnixMilli(parsed)
 	}
+	return since, until, nil
+}
+
+func ownerGetSales(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	since, until, err := parseSinceUntil(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	groupBy, loc, err := parseSalesGroupBy(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
 
 	owner := r.Context().Value("owner").(*Owner)
 
@@ -141,9 +163,19 @@ func ownerGetSales(w http.ResponseWriter, r *http.Request) {
 	}
 
 	chairSalesMap := make(map[string]int)
+	chairSeriesMap := map[string]*salesSeries{}
+	modelSeriesMap := map[string]*salesSeries{}
+	chairModelMap := make(map[string]string, len(chairs))
+	for _, chair := range chairs {
+		chairModelMap[chair.ID] = chair.Model
+	}
 	for _, ride := range rides {
 		if ride.ChairID.Valid {
 			chairSalesMap[ride.ChairID.String] += calculateSale(ride)
+			if groupBy != "" {
+				addToSalesSeries(chairSeriesMap, ride.ChairID.String, groupBy, loc, ride)
+				addToSalesSeries(modelSeriesMap, chairModelMap[ride.ChairID.String], groupBy, loc, ride)
+			}
 		}
 	}
 
@@ -156,27 +188,44 @@ func ownerGetSales(w http.ResponseWriter, r *http.Request) {
 		sales := chairSalesMap[chair.ID]
 		res.TotalSales += sales
 
-		res.Chairs = append(res.Chairs, chairSales{
+		cs := chairSales{
 			ID:    chair.ID,
 			Name:  chair.Name,
 			Sales: sales,
-		})
+		}
+		if series, ok := chairSeriesMap[chair.ID]; ok {
+			cs.Series = series.result()
+		}
+		res.Chairs = append(res.Chairs, cs)
 
 		modelSalesByModel[chair.Model] += sales
 	}
 
 	models := []modelSales{}
 	for model, sales := range modelSalesByModel {
-		models = append(models, modelSales{
+		ms := modelSales{
 			Model: model,
 			Sales: sales,
-		})
+		}
+		if series, ok := modelSeriesMap[model]; ok {
+			ms.Series = series.result()
+		}
+		models = append(models, ms)
 	}
 	res.Models = models
 
 	writeJSON(w, http.StatusOK, res)
 }
 
+func addToSalesSeries(seriesMap map[string]*salesSeries, key string, groupBy string, loc *time.Location, ride Ride) {
+	series, ok := seriesMap[key]
+	if !ok {
+		series = newSalesSeries(groupBy, loc)
+		seriesMap[key] = series
+	}
+	series.add(ride)
+}
+
 func sumSales(rides []Ride) int {
 	sale := 0
 	for _, ride := range rides {
@@ -186,7 +235,7 @@ func sumSales(rides []Ride) int {
 }
 
 func calculateSale(ride Ride) int {
-	return calculateFare(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+	return ride.TotalFare
 }
 
 type ownerGetChairResponse struct {
@@ -208,7 +257,7 @@ func ownerGetChairs(w http.ResponseWriter, r *http.Request) {
 	owner := ctx.Value("owner").(*Owner)
 
 	chairs := []Chair{}
-	if err := db.SelectContext(ctx, &chairs, `SELECT * FROM chairs WHERE owner_id = ?`, owner.ID); err != nil {
+	if err := db.SelectContext(ctx, &chairs, `SELECT * FROM chairs WHERE owner_id = ? AND deleted_at IS NULL`, owner.ID); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
@@ -217,19 +266,680 @@ func ownerGetChairs(w http.ResponseWriter, r *http.Request) {
 		Chairs: make([]ownerGetChairResponseChair, 0, len(chairs)),
 	}
 	for _, chair := range chairs {
-		c := ownerGetChairResponseChair{
-			ID:            chair.ID,
-			Name:          chair.Name,
-			Model:         chair.Model,
-			Active:        chair.IsActive,
-			RegisteredAt:  chair.CreatedAt.UnixMilli(),
-			TotalDistance: chair.TotalDistance,
+		res.Chairs = append(res.Chairs, newOwnerGetChairResponseChair(&chair))
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func newOwnerGetChairResponseChair(chair *Chair) ownerGetChairResponseChair {
+	c := ownerGetChairResponseChair{
+		ID:            chair.ID,
+		Name:          chair.Name,
+		Model:         chair.Model,
+		Active:        chair.IsActive,
+		RegisteredAt:  chair.CreatedAt.UnixMilli(),
+		TotalDistance: chair.TotalDistance,
+	}
+	if chair.TotalDistanceUpdatedAt.Valid {
+		t := chair.TotalDistanceUpdatedAt.Time.UnixMilli()
+		c.TotalDistanceUpdatedAt = &t
+	}
+	return c
+}
+
+var errChairNotFound = errors.New("chair not found")
+
+// 他のオーナーのイスは存在しないものとして扱う
+func getOwnedChair(ctx context.Context, owner *Owner, chairID string) (*Chair, error) {
+	chair := &Chair{}
+	if err := db.GetContext(ctx, chair, "SELECT * FROM chairs WHERE id = ?", chairID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errChairNotFound
 		}
-		if chair.TotalDistanceUpdatedAt.Valid {
-			t := chair.TotalDistanceUpdatedAt.Time.UnixMilli()
-			c.TotalDistanceUpdatedAt = &t
+		return nil, err
+	}
+	if chair.OwnerID != owner.ID {
+		return nil, errChairNotFound
+	}
+	return chair, nil
+}
+
+func writeOwnedChairError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errChairNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err)
+}
+
+// 1回で返す座標の数。続きは next_cursor を cursor に渡して取得する
+const (
+	defaultChairLocationsLimit = 1000
+	maxChairLocationsLimit     = 10000
+)
+
+type ownerGetChairLocationsResponse struct {
+	ChairID    string                                   `json:"chair_id"`
+	Locations  []ownerGetChairLocationsResponseLocation `json:"locations"`
+	Rides      []ownerGetChairLocationsResponseRide     `json:"rides"`
+	NextCursor *string                                  `json:"next_cursor"`
+}
+
+type ownerGetChairLocationsResponseLocation struct {
+	Latitude   int   `json:"latitude"`
+	Longitude  int   `json:"longitude"`
+	RecordedAt int64 `json:"recorded_at"`
+}
+
+// ライドが移動履歴のどの区間に当たるか。ended_at が無いものはまだ到着していない
+type ownerGetChairLocationsResponseRide struct {
+	RideID    string `json:"ride_id"`
+	StartedAt int64  `json:"started_at"`
+	EndedAt   *int64 `json:"ended_at,omitempty"`
+}
+
+func ownerGetChairLocations(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	chairID := r.PathValue("chair_id")
+
+	since, until, err := parseSinceUntil(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	limit := defaultChairLocationsLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxChairLocationsLimit {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("limit must be between 1 and %d", maxChairLocationsLimit))
+			return
 		}
-		res.Chairs = append(res.Chairs, c)
 	}
+	var cursor *chairLocationCursor
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		cursor, err = parseChairLocationCursor(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	if _, err := getOwnedChair(ctx, owner, chairID); err != nil {
+		writeOwnedChairError(w, err)
+		return
+	}
+
+	// 直近の座標はまだバッファにあるので、DB を読む前に取っておいて足し合わせる
+	buffered := bufferedChairLocations(chairID, since, until)
+
+	query := `SELECT * FROM chair_locations WHERE chair_id = ? AND created_at BETWEEN ? AND ?`
+	args := []any{chairID, since, until}
+	if cursor != nil {
+		query += ` AND (created_at > ? OR (created_at = ? AND id > ?))`
+		args = append(args, cursor.createdAt, cursor.createdAt, cursor.id)
+	}
+	// 続きがあるかを知るために1件多く読む
+	query += ` ORDER BY created_at, id LIMIT ?`
+	args = append(args, limit+1)
+	locations := []ChairLocation{}
+	if err := db.SelectContext(ctx, &locations, query, args...); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	locations = mergeBufferedChairLocations(locations, buffered, cursor)
+	var nextCursor *string
+	if len(locations) > limit {
+		locations = locations[:limit]
+		last := locations[limit-1]
+		next := (&chairLocationCursor{createdAt: last.CreatedAt, id: last.ID}).String()
+		nextCursor = &next
+	}
+
+	rides := []Ride{}
+	if err := db.SelectContext(
+		ctx,
+		&rides,
+		`SELECT * FROM rides
+		WHERE chair_id = ? AND trace_started_at IS NOT NULL
+		  AND trace_started_at <= ? AND (trace_ended_at IS NULL OR trace_ended_at >= ?)
+		ORDER BY trace_started_at`,
+		chairID, until, since,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := ownerGetChairLocationsResponse{
+		ChairID:    chairID,
+		Locations:  make([]ownerGetChairLocationsResponseLocation, 0, len(locations)),
+		Rides:      make([]ownerGetChairLocationsResponseRide, 0, len(rides)),
+		NextCursor: nextCursor,
+	}
+	for _, location := range locations {
+		res.Locations = append(res.Locations, ownerGetChairLocationsResponseLocation{
+			Latitude:   location.Latitude,
+			Longitude:  location.Longitude,
+			RecordedAt: location.CreatedAt.UnixMilli(),
+		})
+	}
+	for _, ride := range rides {
+		item := ownerGetChairLocationsResponseRide{
+			RideID:    ride.ID,
+			StartedAt: ride.TraceStartedAt.Time.UnixMilli(),
+		}
+		if ride.TraceEndedAt.Valid {
+			endedAt := ride.TraceEndedAt.Time.UnixMilli()
+			item.EndedAt = &endedAt
+		}
+		res.Rides = append(res.Rides, item)
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+// chairLocationCursor は前のページで最後に返した座標の位置。"<created_at の UNIX マイクロ秒>_<id>" で受け渡す
+type chairLocationCursor struct {
+	createdAt time.Time
+	id        string
+}
+
+func parseChairLocationCursor(s string) (*chairLocationCursor, error) {
+	micro, id, ok := strings.Cut(s, "_")
+	if !ok || id == "" {
+		return nil, errors.New("invalid cursor")
+	}
+	parsed, err := strconv.ParseInt(micro, 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	return &chairLocationCursor{createdAt: time.UnixMicro(parsed), id: id}, nil
+}
+
+func (c *chairLocationCursor) String() string {
+	return strconv.FormatInt(c.createdAt.UnixMicro(), 10) + "_" + c.id
+}
+
+func (c *chairLocationCursor) before(location *ChairLocation) bool {
+	if !location.CreatedAt.Equal(c.createdAt) {
+		return location.CreatedAt.After(c.createdAt)
+	}
+	return location.ID > c.id
+}
+
+// mergeBufferedChairLocations は DB から読んだ座標にバッファの座標を足して、created_at, id の順に並べ直す
+// バッファから読んだ後に書き出されたものは両方に入っているので ID で除く
+func mergeBufferedChairLocations(locations []ChairLocation, buffered []ChairLocation, cursor *chairLocationCursor) []ChairLocation {
+	if len(buffered) == 0 {
+		return locations
+	}
+	seen := make(map[string]struct{}, len(locations))
+	for _, location := range locations {
+		seen[location.ID] = struct{}{}
+	}
+	for _, location := range buffered {
+		if _, ok := seen[location.ID]; ok {
+			continue
+		}
+		if cursor != nil && !cursor.before(&location) {
+			continue
+		}
+		locations = append(locations, location)
+	}
+	slices.SortFunc(locations, func(a, b ChairLocation) int {
+		if c := a.CreatedAt.Compare(b.CreatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	return locations
+}
+
+type ownerGetChairAnomaliesResponse struct {
+	ChairID   string                                  `json:"chair_id"`
+	Anomalies []ownerGetChairAnomaliesResponseAnomaly `json:"anomalies"`
+}
+
+type ownerGetChairAnomaliesResponseAnomaly struct {
+	ID             string     `json:"id"`
+	FromCoordinate Coordinate `json:"from_coordinate"`
+	ToCoordinate   Coordinate `json:"to_coordinate"`
+	Distance       int        `json:"distance"`
+	ElapsedMs      int64      `json:"elapsed_ms"`
+	MaxDistance    int        `json:"max_distance"`
+	Action         string     `json:"action"`
+	RecordedAt     int64      `json:"recorded_at"`
+}
+
+func ownerGetChairAnomalies(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	chairID := r.PathValue("chair_id")
+
+	since, until, err := parseSinceUntil(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if _, err := getOwnedChair(ctx, owner, chairID); err != nil {
+		writeOwnedChairError(w, err)
+		return
+	}
+
+	anomalies := []ChairMovementAnomaly{}
+	if err := db.SelectContext(
+		ctx,
+		&anomalies,
+		`SELECT * FROM chair_movement_anomalies WHERE chair_id = ? AND created_at BETWEEN ? AND ? ORDER BY created_at`,
+		chairID, since, until,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := ownerGetChairAnomaliesResponse{
+		ChairID:   chairID,
+		Anomalies: make([]ownerGetChairAnomaliesResponseAnomaly, 0, len(anomalies)),
+	}
+	for _, anomaly := range anomalies {
+		res.Anomalies = append(res.Anomalies, ownerGetChairAnomaliesResponseAnomaly{
+			ID:             anomaly.ID,
+			FromCoordinate: Coordinate{Latitude: anomaly.FromLatitude, Longitude: anomaly.FromLongitude},
+			ToCoordinate:   Coordinate{Latitude: anomaly.ToLatitude, Longitude: anomaly.ToLongitude},
+			Distance:       anomaly.Distance,
+			ElapsedMs:      anomaly.ElapsedMs,
+			MaxDistance:    anomaly.MaxDistance,
+			Action:         anomaly.Action,
+			RecordedAt:     anomaly.CreatedAt.UnixMilli(),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+// chairs.name の長さ
+const chairNameMaxLength = 30
+
+var (
+	errUnknownChairModel  = errors.New("unknown chair model")
+	errChairHasActiveRide = errors.New("chair has an active ride")
+)
+
+// 省略したフィールドは変更しない。active は強制的に受付停止にする false だけを受け付ける
+type ownerPatchChairRequest struct {
+	Name   *string `json:"name"`
+	Model  *string `json:"model"`
+	Active *bool   `json:"active"`
+}
+
+func ownerPatchChair(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	chairID := r.PathValue("chair_id")
+
+	req := &ownerPatchChairRequest{}
+	if err := bindJSON(r, req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Name == nil && req.Model == nil && req.Active == nil {
+		writeError(w, http.StatusBadRequest, errors.New("none of name, model and active is specified"))
+		return
+	}
+	if req.Name != nil && (*req.Name == "" || utf8.RuneCountInString(*req.Name) > chairNameMaxLength) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("name must be 1 to %d characters", chairNameMaxLength))
+		return
+	}
+	if req.Model != nil && *req.Model == "" {
+		writeError(w, http.StatusBadRequest, errors.New("model is empty"))
+		return
+	}
+	if req.Active != nil && *req.Active {
+		// 受付の再開はイス自身が chairPostActivity で行う
+		writeError(w, http.StatusBadRequest, errors.New("active can only be set to false"))
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	chair, err := lockOwnedChair(ctx, tx, owner, chairID)
+	if err != nil {
+		writeOwnedChairError(w, err)
+		return
+	}
+
+	if req.Name != nil {
+		chair.Name = *req.Name
+	}
+	if req.Model != nil {
+		var count int
+		if err := tx.GetContext(ctx, &count, "SELECT COUNT(*) FROM chair_models WHERE name = ?", *req.Model); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if count == 0 {
+			writeError(w, http.StatusBadRequest, errUnknownChairModel)
+			return
+		}
+		chair.Model = *req.Model
+	}
+	if req.Active != nil {
+		chair.IsActive = *req.Active
+	}
+
+	if _, err := tx.ExecContext(
+		ctx,
+		"UPDATE chairs SET name = ?, model = ?, is_active = ? WHERE id = ?",
+		chair.Name, chair.Model, chair.IsActive, chair.ID,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if err := tx.GetContext(ctx, chair, "SELECT * FROM chairs WHERE id = ?", chair.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// キャッシュ済みのイスは古い名前やモデルを持っている
+	invalidateChairAuthToken(chair.AccessToken)
+	chairIndex.put(chair)
+
+	writeJSON(w, http.StatusOK, newOwnerGetChairResponseChair(chair))
+}
+
+// ownerDeleteChair はイスを退役させる。売上の履歴を残すため行は消さない
+func ownerDeleteChair(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	chairID := r.PathValue("chair_id")
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	chair, err := lockOwnedChair(ctx, tx, owner, chairID)
+	if err != nil {
+		writeOwnedChairError(w, err)
+		return
+	}
+
+	var activeRides int
+	if err := tx.GetContext(
+		ctx,
+		&activeRides,
+		`SELECT COUNT(*) FROM rides
+		WHERE chair_id = ?
+		  AND NOT EXISTS (SELECT 1 FROM ride_statuses WHERE ride_statuses.ride_id = rides.id AND ride_statuses.status IN (?, ?))`,
+		chair.ID, rideStatusCompleted, rideStatusCanceled,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if activeRides > 0 {
+		writeError(w, http.StatusConflict, errChairHasActiveRide)
+		return
+	}
+
+	if _, err := tx.ExecContext(
+		ctx,
+		"UPDATE chairs SET is_active = FALSE, deleted_at = CURRENT_TIMESTAMP(6) WHERE id = ?",
+		chair.ID,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// 退役したイスのトークンは以降の認証で弾く
+	invalidateChairAuthToken(chair.AccessToken)
+	rideCacheByChairIDMutex.Lock()
+	delete(rideCacheByChairID, chair.ID)
+	rideCacheByChairIDMutex.Unlock()
+	chairIndex.remove(chair.ID)
+	chairNotifier.notify(chair.ID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// 退役済みのイスは存在しないものとして扱う
+func lockOwnedChair(ctx context.Context, tx *sqlx.Tx, owner *Owner, chairID string) (*Chair, error) {
+	chair := &Chair{}
+	if err := tx.GetContext(ctx, chair, "SELECT * FROM chairs WHERE id = ? AND deleted_at IS NULL FOR UPDATE", chairID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errChairNotFound
+		}
+		return nil, err
+	}
+	if chair.OwnerID != owner.ID {
+		return nil, errChairNotFound
+	}
+	return chair, nil
+}
+
+type ownerPostChairRegisterTokenResponse struct {
+	ChairRegisterToken string `json:"chair_register_token"`
+}
+
+// ownerPostChairRegisterToken はイスの登録に使うトークンを作り直す。登録済みのイスには影響しない
+func ownerPostChairRegisterToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	chairRegisterToken := secureRandomStr(32)
+	if _, err := db.ExecContext(ctx, "UPDATE owners SET chair_register_token = ? WHERE id = ?", chairRegisterToken, owner.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &ownerPostChairRegisterTokenResponse{
+		ChairRegisterToken: chairRegisterToken,
+	})
+}
+
+type ownerPostChairAccessTokenResponse struct {
+	ChairID     string `json:"chair_id"`
+	AccessToken string `json:"access_token"`
+}
+
+// ownerPostChairAccessToken はイスのアクセストークンを発行し直す。古いトークンはすぐに使えなくなる
+func ownerPostChairAccessToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	chairID := r.PathValue("chair_id")
+
+	accessToken := secureRandomStr(32)
+	if err := replaceChairAccessToken(ctx, owner, chairID, accessToken); err != nil {
+		writeOwnedChairError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &ownerPostChairAccessTokenResponse{
+		ChairID:     chairID,
+		AccessToken: accessToken,
+	})
+}
+
+// ownerDeleteChairAccessToken はイスのアクセストークンを失効させる
+// 誰にも渡さないトークンに置き換えるので、発行し直すまでイスは認証できない
+func ownerDeleteChairAccessToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	chairID := r.PathValue("chair_id")
+
+	if err := replaceChairAccessToken(ctx, owner, chairID, secureRandomStr(32)); err != nil {
+		writeOwnedChairError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func replaceChairAccessToken(ctx context.Context, owner *Owner, chairID string, accessToken string) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	chair, err := lockOwnedChair(ctx, tx, owner, chairID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE chairs SET access_token = ? WHERE id = ?", accessToken, chair.ID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	invalidateChairAuthToken(chair.AccessToken)
+	// 接続中の通知ストリームを起こして切断させる
+	chairNotifier.notify(chair.ID)
+	return nil
+}
+
+type ownerGetPayoutsResponse struct {
+	CommissionRates []ownerGetPayoutsResponseCommissionRate `json:"commission_rates"`
+	// まだ締めていない仕訳の合計。精算期間が終わると statements に移る
+	Pending    ownerGetPayoutsResponseTotal       `json:"pending"`
+	Statements []ownerGetPayoutsResponseStatement `json:"statements"`
+}
+
+type ownerGetPayoutsResponseCommissionRate struct {
+	Model             string `json:"model" db:"model"`
+	CommissionPercent int    `json:"commission_percent" db:"commission_percent"`
+}
+
+type ownerGetPayoutsResponseTotal struct {
+	Rides         int `json:"rides"`
+	RiderCharges  int `json:"rider_charges"`
+	CouponSubsidy int `json:"coupon_subsidy"`
+	PlatformFee   int `json:"platform_fee"`
+	OwnerEarnings int `json:"owner_earnings"`
+}
+
+type ownerGetPayoutsResponseStatement struct {
+	ID          string `json:"id"`
+	PeriodStart int64  `json:"period_start"`
+	PeriodEnd   int64  `json:"period_end"`
+	ownerGetPayoutsResponseTotal
+	SettledAt int64 `json:"settled_at"`
+}
+
+// ownerGetPayouts は精算明細を新しい期間から返す。since, until は精算期間の開始日時で絞り込む
+func ownerGetPayouts(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	since, until, err := parseSinceUntil(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer tx.Rollback()
+
+	statements := []PayoutStatement{}
+	if err := tx.SelectContext(
+		ctx,
+		&statements,
+		`SELECT * FROM payout_statements WHERE owner_id = ? AND period_start BETWEEN ? AND ? ORDER BY period_start DESC`,
+		owner.ID, since, until,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	pendingEntries := []struct {
+		EntryType string `db:"entry_type"`
+		Count     int    `db:"count"`
+		Amount    int    `db:"amount"`
+	}{}
+	if err := tx.SelectContext(
+		ctx,
+		&pendingEntries,
+		`SELECT entry_type, COUNT(*) AS count, COALESCE(SUM(amount), 0) AS amount
+		FROM ledger_entries
+		WHERE owner_id = ? AND statement_id IS NULL
+		GROUP BY entry_type`,
+		owner.ID,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// オーナーのイスのモデルに今かかっている手数料率
+	rates := []ownerGetPayoutsResponseCommissionRate{}
+	if err := tx.SelectContext(
+		ctx,
+		&rates,
+		`SELECT DISTINCT chairs.model AS model, COALESCE(chair_models.commission_percent, ?) AS commission_percent
+		FROM chairs
+		LEFT JOIN chair_models ON chair_models.name = chairs.model
+		WHERE chairs.owner_id = ?
+		ORDER BY chairs.model`,
+		defaultCommissionPercent, owner.ID,
+	); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := ownerGetPayoutsResponse{
+		CommissionRates: rates,
+		Statements:      make([]ownerGetPayoutsResponseStatement, 0, len(statements)),
+	}
+	pending := &payoutTotal{}
+	for _, entry := range pendingEntries {
+		pending.add(entry.EntryType, entry.Amount)
+		if entry.EntryType == ledgerEntryRiderCharge {
+			pending.rides = entry.Count
+		}
+	}
+	res.Pending = ownerGetPayoutsResponseTotal{
+		Rides:         pending.rides,
+		RiderCharges:  pending.riderCharges,
+		CouponSubsidy: pending.couponSubsidy,
+		PlatformFee:   pending.platformFee,
+		OwnerEarnings: pending.ownerEarnings,
+	}
+	for _, statement := range statements {
+		res.Statements = append(res.Statements, ownerGetPayoutsResponseStatement{
+			ID:          statement.ID,
+			PeriodStart: statement.PeriodStart.UnixMilli(),
+			PeriodEnd:   statement.PeriodEnd.UnixMilli(),
+			ownerGetPayoutsResponseTotal: ownerGetPayoutsResponseTotal{
+				Rides:         statement.Rides,
+				RiderCharges:  statement.RiderCharges,
+				CouponSubsidy: statement.CouponSubsidy,
+				PlatformFee:   statement.PlatformFee,
+				OwnerEarnings: statement.OwnerEarnings,
+			},
+			SettledAt: statement.CreatedAt.UnixMilli(),
+		})
+	}
+
 	writeJSON(w, http.StatusOK, res)
 }
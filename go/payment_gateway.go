@@ -10,88 +10,91 @@ import (
 	"time"
 )
 
-var erroredUpstream = errors.New("errored upstream")
+// 決済サービスが応答しないときに、1回の送信で待つ時間の上限
+const paymentGatewayTimeout = 5 * time.Second
+
+var paymentGatewayClient = &http.Client{Timeout: paymentGatewayTimeout}
+
+// 同じ Idempotency-Key で再送してよい失敗
+var errRetryablePayment = errors.New("retryable payment gateway error")
 
 type paymentGatewayPostPaymentRequest struct {
 	Amount int `json:"amount"`
 }
 
+// 決済サービスが返金済みの決済に付けるステータス
+const paymentGatewayStatusRefunded = "返金済み"
+
 type paymentGatewayGetPaymentsResponseOne struct {
+	ID     string `json:"id"`
 	Amount int    `json:"amount"`
 	Status string `json:"status"`
+	// 決済を作ったときに送った Idempotency-Key。送っていなければ空
+	IdempotencyKey string `json:"idempotency_key"`
+	// 決済日時と返金日時 (UNIXミリ秒)。返金されていなければ refunded_at は nil
+	CreatedAt  int64  `json:"created_at"`
+	RefundedAt *int64 `json:"refunded_at"`
+}
+
+func (p *paymentGatewayGetPaymentsResponseOne) refunded() bool {
+	return p.RefundedAt != nil || p.Status == paymentGatewayStatusRefunded
 }
 
-func requestPaymentGatewayPostPayment(ctx context.Context, paymentGatewayURL string, token string, param *paymentGatewayPostPaymentRequest, retrieveRidesOrderByCreatedAtAsc func() ([]Ride, error)) error {
+// requestPaymentGatewayPostPayment は決済を1回だけ送信し、レスポンスのステータスコードを返す
+// 決済サービスは Idempotency-Key が同じ決済を二重に処理しないので、errRetryablePayment の場合は同じ key で再送してよい
+func requestPaymentGatewayPostPayment(ctx context.Context, paymentGatewayURL string, token string, idempotencyKey string, param *paymentGatewayPostPaymentRequest) (int, error) {
 	b, err := json.Marshal(param)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	// 失敗したらとりあえずリトライ
-	// FIXME: 社内決済マイクロサービスのインフラに異常が発生していて、同時にたくさんリクエストすると変なことになる可能性あり
-	retry := 0
-	for {
-		err := func() error {
-			req, err := http.NewRequestWithContext(ctx, http.MethodPost, paymentGatewayURL+"/payments", bytes.NewBuffer(b))
-			if err != nil {
-				return err
-			}
-			req.Header.Set("Content-Type", "application/json")
-			req.Header.Set("Authorization", "Bearer "+token)
-
-			res, err := http.DefaultClient.Do(req)
-			if err != nil {
-				return err
-			}
-			defer res.Body.Close()
-
-			if res.StatusCode != http.StatusNoContent {
-				// エラーが返ってきても成功している場合があるので、社内決済マイクロサービスに問い合わせ
-				getReq, err := http.NewRequestWithContext(ctx, http.MethodGet, paymentGatewayURL+"/payments", bytes.NewBuffer([]byte{}))
-				if err != nil {
-					return err
-				}
-				getReq.Header.Set("Authorization", "Bearer "+token)
-
-				getRes, err := http.DefaultClient.Do(getReq)
-				if err != nil {
-					return err
-				}
-				defer res.Body.Close()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, paymentGatewayURL+"/payments", bytes.NewBuffer(b))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Idempotency-Key", idempotencyKey)
 
-				// GET /payments は障害と関係なく200が返るので、200以外は回復不能なエラーとする
-				if getRes.StatusCode != http.StatusOK {
-					return fmt.Errorf("[GET /payments] unexpected status code (%d)", getRes.StatusCode)
-				}
-				var payments []paymentGatewayGetPaymentsResponseOne
-				if err := json.NewDecoder(getRes.Body).Decode(&payments); err != nil {
-					return err
-				}
+	res, err := paymentGatewayClient.Do(req)
+	if err != nil {
+		// 届いたかどうか分からないが、同じ key なら再送しても二重決済にはならない
+		return 0, fmt.Errorf("%w: %w", errRetryablePayment, err)
+	}
+	defer res.Body.Close()
 
-				rides, err := retrieveRidesOrderByCreatedAtAsc()
-				if err != nil {
-					return err
-				}
+	switch {
+	case res.StatusCode == http.StatusNoContent:
+		return res.StatusCode, nil
+	// 409: 同じ key の決済が処理中, 429: レートリミット, 5xx: 決済サービスの障害
+	case res.StatusCode == http.StatusConflict || res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500:
+		return res.StatusCode, fmt.Errorf("%w: [POST /payments] unexpected status code (%d)", errRetryablePayment, res.StatusCode)
+	default:
+		return res.StatusCode, fmt.Errorf("[POST /payments] unexpected status code (%d)", res.StatusCode)
+	}
+}
 
-				if len(rides) != len(payments) {
-					return fmt.Errorf("unexpected number of payments: %d != %d. %w", len(rides), len(payments), erroredUpstream)
-				}
+// requestPaymentGatewayGetPayments はトークンに紐づく決済の一覧を取得する
+func requestPaymentGatewayGetPayments(ctx context.Context, paymentGatewayURL string, token string) ([]paymentGatewayGetPaymentsResponseOne, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, paymentGatewayURL+"/payments", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
 
-				return nil
-			}
-			return nil
-		}()
-		if err != nil {
-			if retry < 5 {
-				retry++
-				time.Sleep(100 * time.Millisecond)
-				continue
-			} else {
-				return err
-			}
-		}
-		break
+	res, err := paymentGatewayClient.Do(req)
+	if err != nil {
+		return nil, err
 	}
+	defer res.Body.Close()
 
-	return nil
+	// GET /payments は障害と関係なく200が返るので、200以外は回復不能なエラーとする
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("[GET /payments] unexpected status code (%d)", res.StatusCode)
+	}
+	var payments []paymentGatewayGetPaymentsResponseOne
+	if err := json.NewDecoder(res.Body).Decode(&payments); err != nil {
+		return nil, err
+	}
+	return payments, nil
 }
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	paymentWorkerInterval    = 200 * time.Millisecond
+	paymentWorkerBatchSize   = 100
+	paymentWorkerConcurrency = 8
+	paymentMaxAttempts       = 10
+	paymentInitialBackoff    = 100 * time.Millisecond
+	paymentMaxBackoff        = 30 * time.Second
+)
+
+const (
+	paymentStatusPending   = "PENDING"
+	paymentStatusSucceeded = "SUCCEEDED"
+	paymentStatusFailed    = "FAILED"
+	// 再送しきっても決済されたかどうか分からない。請求済みかもしれないので reconcile で確かめる
+	paymentStatusUnknown = "UNKNOWN"
+)
+
+var paymentWorker *periodicTask
+
+// ライドの完了時に payments に積まれた決済を送る
+func triggerPaymentWorker() {
+	paymentWorker.trigger()
+}
+
+// n 回目の失敗の後、次に送るまでの待ち時間
+func paymentRetryBackoff(attempts int) time.Duration {
+	backoff := paymentInitialBackoff
+	for i := 1; i < attempts && backoff < paymentMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, paymentMaxBackoff)
+}
+
+// 送信時刻を過ぎた未完了の決済を決済サービスに送る
+func runPaymentWorker(ctx context.Context) error {
+	payments := []*Payment{}
+	if err := db.SelectContext(
+		ctx,
+		&payments,
+		`SELECT * FROM payments WHERE status = ? AND next_attempt_at <= CURRENT_TIMESTAMP(6) ORDER BY next_attempt_at LIMIT ?`,
+		paymentStatusPending, paymentWorkerBatchSize,
+	); err != nil {
+		return err
+	}
+	if len(payments) == 0 {
+		return nil
+	}
+
+	var paymentGatewayURL string
+	if err := db.GetContext(ctx, &paymentGatewayURL, "SELECT value FROM settings WHERE name = 'payment_gateway_url'"); err != nil {
+		return err
+	}
+
+	// 同時にたくさんリクエストすると決済サービスがおかしくなることがあるので、同時実行数を絞る
+	sem := make(chan struct{}, paymentWorkerConcurrency)
+	wg := sync.WaitGroup{}
+	for _, payment := range payments {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := processPayment(ctx, paymentGatewayURL, payment); err != nil && ctx.Err() == nil {
+				slog.Error("failed to process payment", slog.String("ride_id", payment.RideID), slog.Any("error", err))
+			}
+		}()
+	}
+	wg.Wait()
+
+	return nil
+}
+
+func processPayment(ctx context.Context, paymentGatewayURL string, payment *Payment) error {
+	token := ""
+	if err := db.GetContext(ctx, &token, `SELECT token FROM payment_tokens WHERE user_id = ?`, payment.UserID); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+	}
+
+	attempts := payment.Attempts + 1
+	statusCode := 0
+	var err error
+	if token == "" {
+		err = errors.New("payment token not registered")
+	} else {
+		statusCode, err = requestPaymentGatewayPostPayment(ctx, paymentGatewayURL, token, payment.IdempotencyKey, &paymentGatewayPostPaymentRequest{
+			Amount: payment.Amount,
+		})
+	}
+	if ctx.Err() != nil {
+		// シャットダウンで中断したものは試行に数えない
+		return ctx.Err()
+	}
+
+	var attemptStatusCode *int
+	if statusCode != 0 {
+		attemptStatusCode = &statusCode
+	}
+	var attemptError *string
+	if err != nil {
+		msg := err.Error()
+		attemptError = &msg
+	}
+	if _, err := db.ExecContext(
+		ctx,
+		`INSERT INTO payment_attempts (id, ride_id, attempt, status_code, error) VALUES (?, ?, ?, ?, ?)`,
+		ulid.Make().String(), payment.RideID, attempts, attemptStatusCode, attemptError,
+	); err != nil {
+		return err
+	}
+
+	switch {
+	case err == nil:
+		_, err := db.ExecContext(
+			ctx,
+			`UPDATE payments SET status = ?, attempts = ?, last_error = NULL WHERE ride_id = ?`,
+			paymentStatusSucceeded, attempts, payment.RideID,
+		)
+		return err
+	case errors.Is(err, errRetryablePayment) && attempts < paymentMaxAttempts:
+		_, err := db.ExecContext(
+			ctx,
+			`UPDATE payments SET attempts = ?, last_error = ?, next_attempt_at = CURRENT_TIMESTAMP(6) + INTERVAL ? MICROSECOND WHERE ride_id = ?`,
+			attempts, attemptError, paymentRetryBackoff(attempts).Microseconds(), payment.RideID,
+		)
+		return err
+	case errors.Is(err, errRetryablePayment):
+		// 決済サービスに届いて請求済みの可能性があるので、失敗扱いにもクーポンの返却もしない
+		slog.Warn("payment outcome unknown", slog.String("ride_id", payment.RideID), slog.Int("attempts", attempts), slog.Any("error", err))
+		_, err := db.ExecContext(
+			ctx,
+			`UPDATE payments SET status = ?, attempts = ?, last_error = ? WHERE ride_id = ?`,
+			paymentStatusUnknown, attempts, attemptError, payment.RideID,
+		)
+		return err
+	default:
+		slog.Warn("payment failed", slog.String("ride_id", payment.RideID), slog.Int("attempts", attempts), slog.Any("error", err))
+		tx, err := db.Beginx()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.ExecContext(
+			ctx,
+			`UPDATE payments SET status = ?, attempts = ?, last_error = ? WHERE ride_id = ?`,
+			paymentStatusFailed, attempts, attemptError, payment.RideID,
+		); err != nil {
+			return err
+		}
+		// 支払われなかったライドのクーポンは使われなかったことにする
+		if err := releaseCoupon(ctx, tx, payment.RideID); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+}
+
+// ライドごとの決済状態。payments が無いライドは含まれない
+func getPaymentStatusBulk(ctx context.Context, tx *sqlx.Tx, rideIDs []string) (map[string]string, error) {
+	statusMap := map[string]string{}
+	if len(rideIDs) == 0 {
+		return statusMap, nil
+	}
+	query, args, err := sqlx.In(`SELECT ride_id, status FROM payments WHERE ride_id IN (?)`, rideIDs)
+	if err != nil {
+		return nil, err
+	}
+	payments := []Payment{}
+	if err := tx.SelectContext(ctx, &payments, tx.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+	for _, payment := range payments {
+		statusMap[payment.RideID] = payment.Status
+	}
+	return statusMap, nil
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+// ledger_entries.entry_type
+// 1つのライドにつき4行を計上し、RIDE_CLEARING の借方と貸方が必ず釣り合う
+//
+//	RIDER_CHARGE   RIDER_RECEIVABLE / RIDE_CLEARING    ユーザーへの請求額 (total_fare)
+//	COUPON_SUBSIDY COUPON_EXPENSE   / RIDE_CLEARING    クーポンの割引をプラットフォームが補填する額 (discount)
+//	PLATFORM_FEE   RIDE_CLEARING    / PLATFORM_REVENUE 割引前の運賃にかかる手数料
+//	OWNER_EARNINGS RIDE_CLEARING    / OWNER_PAYABLE    割引前の運賃から手数料を引いたオーナーの取り分
+const (
+	ledgerEntryRiderCharge   = "RIDER_CHARGE"
+	ledgerEntryCouponSubsidy = "COUPON_SUBSIDY"
+	ledgerEntryPlatformFee   = "PLATFORM_FEE"
+	ledgerEntryOwnerEarnings = "OWNER_EARNINGS"
+)
+
+// 勘定科目
+const (
+	ledgerAccountRiderReceivable = "RIDER_RECEIVABLE"
+	ledgerAccountCouponExpense   = "COUPON_EXPENSE"
+	ledgerAccountRideClearing    = "RIDE_CLEARING"
+	ledgerAccountPlatformRevenue = "PLATFORM_REVENUE"
+	ledgerAccountOwnerPayable    = "OWNER_PAYABLE"
+)
+
+// chair_models に無いモデルのイスに使う手数料率。chair_models.commission_percent の初期値と同じ
+const defaultCommissionPercent = 10
+
+const payoutSettlementInterval = time.Minute
+
+// 1回のトランザクションで精算するライドの数
+const payoutSettlementBatchSize = 500
+
+var currentPayoutPeriod = salesGroupByWeek
+
+func getPayoutPeriod() string {
+	// ISUCON_PAYOUT_PERIOD は day / week / month
+	switch v := os.Getenv("ISUCON_PAYOUT_PERIOD"); v {
+	case "":
+		return salesGroupByWeek
+	case salesGroupByDay, salesGroupByWeek, salesGroupByMonth:
+		return v
+	default:
+		slog.Warn("unknown ISUCON_PAYOUT_PERIOD, using week", slog.String("value", v))
+		return salesGroupByWeek
+	}
+}
+
+// 精算期間は UTC で区切る
+func payoutPeriodStart(t time.Time) time.Time {
+	return salesBucketStart(t, currentPayoutPeriod, time.UTC)
+}
+
+func payoutPeriodEnd(start time.Time) time.Time {
+	switch currentPayoutPeriod {
+	case salesGroupByDay:
+		return start.AddDate(0, 0, 1)
+	case salesGroupByMonth:
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.AddDate(0, 0, 7)
+	}
+}
+
+type rideLedger struct {
+	riderCharge   int
+	couponSubsidy int
+	platformFee   int
+	ownerEarnings int
+}
+
+// 手数料は割引前の運賃にかけるので、クーポンを使われてもオーナーの取り分は減らない
+func splitRideFare(ride *Ride, commissionPercent int) rideLedger {
+	grossFare := ride.TotalFare + ride.Discount
+	platformFee := grossFare * commissionPercent / 100
+	return rideLedger{
+		riderCharge:   ride.TotalFare,
+		couponSubsidy: ride.Discount,
+		platformFee:   platformFee,
+		ownerEarnings: grossFare - platformFee,
+	}
+}
+
+// recordRideLedgerEntries は完了したライドの仕訳を計上する。COMPLETED と同じトランザクションで呼ぶ
+func recordRideLedgerEntries(ctx context.Context, tx *sqlx.Tx, ride *Ride) error {
+	var chair struct {
+		OwnerID           string        `db:"owner_id"`
+		CommissionPercent sql.NullInt32 `db:"commission_percent"`
+	}
+	if err := tx.GetContext(
+		ctx,
+		&chair,
+		`SELECT chairs.owner_id, chair_models.commission_percent
+		FROM chairs
+		LEFT JOIN chair_models ON chair_models.name = chairs.model
+		WHERE chairs.id = ?`,
+		ride.ChairID.String,
+	); err != nil {
+		return err
+	}
+	commissionPercent := defaultCommissionPercent
+	if chair.CommissionPercent.Valid {
+		commissionPercent = int(chair.CommissionPercent.Int32)
+	}
+
+	ledger := splitRideFare(ride, commissionPercent)
+	entries := []LedgerEntry{
+		{EntryType: ledgerEntryRiderCharge, DebitAccount: ledgerAccountRiderReceivable, CreditAccount: ledgerAccountRideClearing, Amount: ledger.riderCharge},
+		{EntryType: ledgerEntryCouponSubsidy, DebitAccount: ledgerAccountCouponExpense, CreditAccount: ledgerAccountRideClearing, Amount: ledger.couponSubsidy},
+		{EntryType: ledgerEntryPlatformFee, DebitAccount: ledgerAccountRideClearing, CreditAccount: ledgerAccountPlatformRevenue, Amount: ledger.platformFee},
+		{EntryType: ledgerEntryOwnerEarnings, DebitAccount: ledgerAccountRideClearing, CreditAccount: ledgerAccountOwnerPayable, Amount: ledger.ownerEarnings},
+	}
+	for i := range entries {
+		entries[i].RideID = ride.ID
+		entries[i].OwnerID = chair.OwnerID
+	}
+	_, err := tx.NamedExecContext(
+		ctx,
+		`INSERT INTO ledger_entries (ride_id, entry_type, owner_id, debit_account, credit_account, amount)
+		VALUES (:ride_id, :entry_type, :owner_id, :debit_account, :credit_account, :amount)`,
+		entries,
+	)
+	return err
+}
+
+// payoutTotal は精算明細1件分の合計
+type payoutTotal struct {
+	rides         int
+	riderCharges  int
+	couponSubsidy int
+	platformFee   int
+	ownerEarnings int
+}
+
+func (t *payoutTotal) add(entryType string, amount int) {
+	switch entryType {
+	case ledgerEntryRiderCharge:
+		t.rides++
+		t.riderCharges += amount
+	case ledgerEntryCouponSubsidy:
+		t.couponSubsidy += amount
+	case ledgerEntryPlatformFee:
+		t.platformFee += amount
+	case ledgerEntryOwnerEarnings:
+		t.ownerEarnings += amount
+	}
+}
+
+// runPayoutSettlement は終わった精算期間の未精算の仕訳を、オーナーと期間ごとの精算明細にまとめる
+// 期間の終わり際に計上された仕訳が後から見つかったときは、その期間の明細に足し込む
+// ロックを長く握らないよう、オーナーと期間ごとに payoutSettlementBatchSize ライドずつ別のトランザクションで締める
+func runPayoutSettlement(ctx context.Context) error {
+	currentPeriodStart := payoutPeriodStart(time.Now())
+
+	ownerIDs := []string{}
+	if err := db.SelectContext(
+		ctx,
+		&ownerIDs,
+		`SELECT DISTINCT owner_id FROM ledger_entries WHERE statement_id IS NULL AND created_at < ?`,
+		currentPeriodStart,
+	); err != nil {
+		return err
+	}
+
+	batches, rides := 0, 0
+	for _, ownerID := range ownerIDs {
+		for {
+			n, err := settlePayoutBatch(ctx, ownerID, currentPeriodStart)
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				break
+			}
+			batches++
+			rides += n
+		}
+	}
+
+	if batches > 0 {
+		slog.Info("payout statements settled", slog.Int("owners", len(ownerIDs)), slog.Int("batches", batches), slog.Int("rides", rides))
+	}
+	return nil
+}
+
+// settlePayoutBatch はオーナーの未精算の仕訳のうち最も古い期間から、最大 payoutSettlementBatchSize ライド分を明細に足し込む
+// 締めたライドの数を返す。0 なら before より前に未精算の仕訳は残っていない
+func settlePayoutBatch(ctx context.Context, ownerID string, before time.Time) (int, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var oldest sql.NullTime
+	if err := tx.GetContext(
+		ctx,
+		&oldest,
+		`SELECT MIN(created_at) FROM ledger_entries WHERE owner_id = ? AND statement_id IS NULL AND created_at < ?`,
+		ownerID, before,
+	); err != nil {
+		return 0, err
+	}
+	if !oldest.Valid {
+		return 0, nil
+	}
+	periodStart := payoutPeriodStart(oldest.Time)
+	periodEnd := payoutPeriodEnd(periodStart)
+
+	// 1つのライドの仕訳は同時に計上されるので、ライド単位で締める
+	rideIDs := []string{}
+	if err := tx.SelectContext(
+		ctx,
+		&rideIDs,
+		`SELECT ride_id FROM ledger_entries
+		WHERE owner_id = ? AND statement_id IS NULL AND created_at >= ? AND created_at < ? AND entry_type = ?
+		ORDER BY created_at
+		LIMIT ?
+		FOR UPDATE`,
+		ownerID, periodStart, periodEnd, ledgerEntryRiderCharge, payoutSettlementBatchSize,
+	); err != nil {
+		return 0, err
+	}
+	if len(rideIDs) == 0 {
+		return 0, nil
+	}
+
+	query, args, err := sqlx.In(`SELECT * FROM ledger_entries WHERE statement_id IS NULL AND ride_id IN (?) FOR UPDATE`, rideIDs)
+	if err != nil {
+		return 0, err
+	}
+	entries := []LedgerEntry{}
+	if err := tx.SelectContext(ctx, &entries, tx.Rebind(query), args...); err != nil {
+		return 0, err
+	}
+	t := &payoutTotal{}
+	for _, entry := range entries {
+		t.add(entry.EntryType, entry.Amount)
+	}
+
+	if _, err := tx.ExecContext(
+		ctx,
+		`INSERT INTO payout_statements (id, owner_id, period_start, period_end, rides, rider_charges, coupon_subsidy, platform_fee, owner_earnings)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+		  rides          = rides + VALUES(rides),
+		  rider_charges  = rider_charges + VALUES(rider_charges),
+		  coupon_subsidy = coupon_subsidy + VALUES(coupon_subsidy),
+		  platform_fee   = platform_fee + VALUES(platform_fee),
+		  owner_earnings = owner_earnings + VALUES(owner_earnings)`,
+		ulid.Make().String(), ownerID, periodStart, periodEnd,
+		t.rides, t.riderCharges, t.couponSubsidy, t.platformFee, t.ownerEarnings,
+	); err != nil {
+		return 0, err
+	}
+
+	var statementID string
+	if err := tx.GetContext(
+		ctx,
+		&statementID,
+		`SELECT id FROM payout_statements WHERE owner_id = ? AND period_start = ?`,
+		ownerID, periodStart,
+	); err != nil {
+		return 0, err
+	}
+	query, args, err = sqlx.In(`UPDATE ledger_entries SET statement_id = ? WHERE statement_id IS NULL AND ride_id IN (?)`, statementID, rideIDs)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, tx.Rebind(query), args...); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(rideIDs), nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// shutdown 時に止めるバックグラウンドタスク
+var backgroundTasks []*periodicTask
+
+// periodicTask は interval ごとに run を実行するバックグラウンドループ
+// trigger が呼ばれた場合は次の tick を待たずにすぐ実行する
+type periodicTask struct {
+	name     string
+	interval time.Duration
+	run      func(ctx context.Context) error
+	wakeup   chan struct{}
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+func startPeriodicTask(name string, interval time.Duration, run func(ctx context.Context) error) *periodicTask {
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &periodicTask{
+		name:     name,
+		interval: interval,
+		run:      run,
+		wakeup:   make(chan struct{}, 1),
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	backgroundTasks = append(backgroundTasks, t)
+	go t.loop()
+	return t
+}
+
+func (t *periodicTask) loop() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-t.wakeup:
+			ticker.Reset(t.interval)
+		}
+
+		if err := t.run(t.ctx); err != nil && t.ctx.Err() == nil {
+			slog.Error("background task failed", slog.String("task", t.name), slog.Any("error", err))
+		}
+	}
+}
+
+// trigger は次の tick を待たずに run を実行させる
+// すでに起床待ちの場合は何もしない
+func (t *periodicTask) trigger() {
+	if t == nil {
+		return
+	}
+	select {
+	case t.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// shutdown は実行中の run を中断し、ループの終了を待つ
+func (t *periodicTask) shutdown() {
+	t.cancel()
+	<-t.done
+}
+
+func shutdownBackgroundTasks() {
+	for _, t := range backgroundTasks {
+		t.shutdown()
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"sync"
+)
+
+const (
+	// サージ倍率を計算する区画の一辺の長さ
+	surgeAreaSize = 50
+	// 待っているライドが空きイスより1台分多いごとに上がる倍率(%)
+	surgeStepPercent = 25
+	surgeMinPercent  = 100
+	surgeMaxPercent  = 200
+)
+
+type surgeArea struct {
+	lat int
+	lon int
+}
+
+func surgeAreaOf(latitude, longitude int) surgeArea {
+	return surgeArea{lat: floorDiv(latitude, surgeAreaSize), lon: floorDiv(longitude, surgeAreaSize)}
+}
+
+func floorDiv(a, b int) int {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+var (
+	// 区画ごとのサージ倍率(%)。マッチングのたびに更新される。載っていない区画は 100%
+	surgePercentByArea      = map[surgeArea]int{}
+	surgePercentByAreaMutex sync.RWMutex
+)
+
+// updateSurgePercents は区画ごとの待っているライド数と空きイス数からサージ倍率を計算し直す
+func updateSurgePercents(waitingRides []*Ride, freeChairs []*Chair) {
+	demand := map[surgeArea]int{}
+	for _, ride := range waitingRides {
+		demand[surgeAreaOf(ride.PickupLatitude, ride.PickupLongitude)]++
+	}
+	supply := map[surgeArea]int{}
+	for _, chair := range freeChairs {
+		if !chair.LocationLat.Valid || !chair.LocationLon.Valid {
+			continue
+		}
+		supply[surgeAreaOf(int(chair.LocationLat.Int32), int(chair.LocationLon.Int32))]++
+	}
+
+	percents := make(map[surgeArea]int, len(demand))
+	for area, d := range demand {
+		if percent := calculateSurgePercent(d, supply[area]); percent != surgeMinPercent {
+			percents[area] = percent
+		}
+	}
+
+	surgePercentByAreaMutex.Lock()
+	surgePercentByArea = percents
+	surgePercentByAreaMutex.Unlock()
+}
+
+// 需要が供給を上回った分だけ、空きイス1台あたりで倍率を上げる
+func calculateSurgePercent(demand, supply int) int {
+	if demand <= supply {
+		return surgeMinPercent
+	}
+	percent := surgeMinPercent + surgeStepPercent*(demand-supply)/max(supply, 1)
+	// 10% 刻みに丸める
+	percent = percent / 10 * 10
+	return min(max(percent, surgeMinPercent), surgeMaxPercent)
+}
+
+// 配車位置での現在のサージ倍率(%)
+func currentSurgePercent(pickupLatitude, pickupLongitude int) int {
+	surgePercentByAreaMutex.RLock()
+	defer surgePercentByAreaMutex.RUnlock()
+	if percent, ok := surgePercentByArea[surgeAreaOf(pickupLatitude, pickupLongitude)]; ok {
+		return percent
+	}
+	return surgeMinPercent
+}
+
+func resetSurgePercents() {
+	surgePercentByAreaMutex.Lock()
+	surgePercentByArea = map[surgeArea]int{}
+	surgePercentByAreaMutex.Unlock()
+}
+
+// fareQuote はライド作成時に確定して rides に保存する運賃の内訳
+// TotalFare = BaseFare + MeteredFare + SurgeFare - Discount
+type fareQuote struct {
+	SurgePercent int
+	BaseFare     int
+	MeteredFare  int
+	SurgeFare    int
+	Discount     int
+	TotalFare    int
+}
+
+// クーポンの割引は距離に応じた運賃 (サージ込み) からだけ引く。coupon は nil でもよい
+func quoteFare(pickupLatitude, pickupLongitude, destLatitude, destLongitude int, surgePercent int, coupon *Coupon) fareQuote {
+	meteredFare := farePerDistance * calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
+	surgedMeteredFare := meteredFare * surgePercent / 100
+	discount := 0
+	if coupon != nil {
+		discount = min(coupon.discountFor(surgedMeteredFare), surgedMeteredFare)
+	}
+	return fareQuote{
+		SurgePercent: surgePercent,
+		BaseFare:     initialFare,
+		MeteredFare:  meteredFare,
+		SurgeFare:    surgedMeteredFare - meteredFare,
+		Discount:     discount,
+		TotalFare:    initialFare + surgedMeteredFare - discount,
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	discrepancyMissing    = "MISSING"    // 完了したライドに対応する決済が無い
+	discrepancyDuplicate  = "DUPLICATE"  // 同じライドに対して二重に決済されている
+	discrepancyMismatch   = "MISMATCH"   // 決済額が割引後の運賃と一致しない
+	discrepancyUnexpected = "UNEXPECTED" // 対応するライドが無い決済
+)
+
+type paymentDiscrepancy struct {
+	UserID         string
+	RideID         string
+	PaymentID      string
+	Kind           string
+	ExpectedAmount *int
+	ActualAmount   *int
+}
+
+// isuride reconcile [-write]
+// 決済トークンを登録している全ユーザーについて、決済サービスの GET /payments と完了したライドを突き合わせる
+func runReconcileCommand(args []string) int {
+	fs := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	write := fs.Bool("write", false, "write discrepancies to the payment_discrepancies table")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	ctx := context.Background()
+	db = connectDB()
+	defer db.Close()
+
+	discrepancies, summary, err := reconcilePayments(ctx)
+	if err != nil {
+		slog.Error("reconcile failed", slog.Any("error", err))
+		return 1
+	}
+
+	printReconcileReport(os.Stdout, discrepancies, summary)
+
+	if *write {
+		if err := saveDiscrepancies(ctx, discrepancies); err != nil {
+			slog.Error("failed to write discrepancies", slog.Any("error", err))
+			return 1
+		}
+	}
+
+	if len(discrepancies) > 0 {
+		return 1
+	}
+	return 0
+}
+
+type reconcileSummary struct {
+	checkedUsers int
+	// 決済をまだ送っている途中で、突き合わせなかったライドの数
+	pendingRides int
+	// 返金済みで突き合わせから除いた決済の数
+	refundedPayments int
+	// 決済サービスに断られて決済しなかったライドの数
+	failedRides int
+}
+
+func reconcilePayments(ctx context.Context) ([]paymentDiscrepancy, reconcileSummary, error) {
+	summary := reconcileSummary{}
+	var paymentGatewayURL string
+	if err := db.GetContext(ctx, &paymentGatewayURL, "SELECT value FROM settings WHERE name = 'payment_gateway_url'"); err != nil {
+		return nil, summary, err
+	}
+
+	paymentTokens := []PaymentToken{}
+	if err := db.SelectContext(ctx, &paymentTokens, `SELECT * FROM payment_tokens ORDER BY user_id`); err != nil {
+		return nil, summary, err
+	}
+
+	discrepancies := []paymentDiscrepancy{}
+	for _, paymentToken := range paymentTokens {
+		payments, err := requestPaymentGatewayGetPayments(ctx, paymentGatewayURL, paymentToken.Token)
+		if err != nil {
+			return nil, summary, fmt.Errorf("user %s: %w", paymentToken.UserID, err)
+		}
+
+		expected, pending, failed, err := expectedChargesForUser(ctx, paymentToken.UserID)
+		if err != nil {
+			return nil, summary, fmt.Errorf("user %s: %w", paymentToken.UserID, err)
+		}
+
+		// 返金された決済は請求されていないものとして扱う
+		// 同じ金額の決済が複数あるときは古いものからライドに対応させるので、決済日時の順に並べる
+		slices.SortStableFunc(payments, func(a, b paymentGatewayGetPaymentsResponseOne) int {
+			return cmp.Compare(a.CreatedAt, b.CreatedAt)
+		})
+		actual := make([]gatewayCharge, 0, len(payments))
+		for _, payment := range payments {
+			if payment.refunded() {
+				summary.refundedPayments++
+				continue
+			}
+			actual = append(actual, gatewayCharge{paymentID: payment.ID, idempotencyKey: payment.IdempotencyKey, amount: payment.Amount})
+		}
+
+		discrepancies = append(discrepancies, comparePayments(paymentToken.UserID, expected, pending, actual)...)
+		summary.pendingRides += len(pending)
+		summary.failedRides += failed
+	}
+	summary.checkedUsers = len(paymentTokens)
+
+	return discrepancies, summary, nil
+}
+
+// idempotencyKey は payments に記録した Idempotency-Key。決済をまだ作っていなければ空
+type expectedCharge struct {
+	rideID         string
+	idempotencyKey string
+	amount         int
+}
+
+// gatewayCharge は決済サービスに記録されている決済1件
+type gatewayCharge struct {
+	paymentID      string
+	idempotencyKey string
+	amount         int
+}
+
+// 完了したライドごとに請求されるべき額
+// payments がまだ PENDING のライドは送信中で結果が決まっていないので pending に分ける
+// FAILED のライドは決済サービスに断られて請求していないので、数だけ返す
+func expectedChargesForUser(ctx context.Context, userID string) ([]expectedCharge, []expectedCharge, int, error) {
+	rides := []struct {
+		ID             string         `db:"id"`
+		TotalFare      int            `db:"total_fare"`
+		PaymentStatus  sql.NullString `db:"payment_status"`
+		IdempotencyKey sql.NullString `db:"idempotency_key"`
+	}{}
+	if err := db.SelectContext(
+		ctx,
+		&rides,
+		`SELECT rides.id, rides.total_fare, payments.status AS payment_status, payments.idempotency_key
+		FROM rides
+		LEFT JOIN payments ON payments.ride_id = rides.id
+		WHERE rides.user_id = ?
+		  AND EXISTS (SELECT 1 FROM ride_statuses WHERE ride_statuses.ride_id = rides.id AND ride_statuses.status = 'COMPLETED')
+		ORDER BY rides.created_at ASC`,
+		userID,
+	); err != nil {
+		return nil, nil, 0, err
+	}
+
+	expected := make([]expectedCharge, 0, len(rides))
+	pending := []expectedCharge{}
+	failed := 0
+	for _, ride := range rides {
+		charge := expectedCharge{rideID: ride.ID, idempotencyKey: ride.IdempotencyKey.String, amount: ride.TotalFare}
+		switch ride.PaymentStatus.String {
+		case paymentStatusPending:
+			pending = append(pending, charge)
+		case paymentStatusFailed:
+			failed++
+		default:
+			expected = append(expected, charge)
+		}
+	}
+	return expected, pending, failed, nil
+}
+
+// comparePayments はまず Idempotency-Key でライドと決済を対応させる
+// Key が無い、あるいは一致しないものは、金額の多重集合として突き合わせる
+// pending のライドは決済サービスに届いていてもいなくても不整合にしない
+func comparePayments(userID string, expected []expectedCharge, pending []expectedCharge, actual []gatewayCharge) []paymentDiscrepancy {
+	discrepancies := []paymentDiscrepancy{}
+
+	actualByKey := map[string]int{}
+	for i, charge := range actual {
+		if charge.idempotencyKey != "" {
+			actualByKey[charge.idempotencyKey] = i
+		}
+	}
+	used := make([]bool, len(actual))
+	takeByKey := func(key string) (gatewayCharge, bool) {
+		i, ok := actualByKey[key]
+		if key == "" || !ok || used[i] {
+			return gatewayCharge{}, false
+		}
+		used[i] = true
+		return actual[i], true
+	}
+
+	matchedRideByAmount := map[int]string{}
+	unresolvedExpected := []expectedCharge{}
+	for _, charge := range expected {
+		got, ok := takeByKey(charge.idempotencyKey)
+		if !ok {
+			unresolvedExpected = append(unresolvedExpected, charge)
+			continue
+		}
+		if got.amount != charge.amount {
+			discrepancies = append(discrepancies, paymentDiscrepancy{
+				UserID:         userID,
+				RideID:         charge.rideID,
+				PaymentID:      got.paymentID,
+				Kind:           discrepancyMismatch,
+				ExpectedAmount: &charge.amount,
+				ActualAmount:   &got.amount,
+			})
+			continue
+		}
+		matchedRideByAmount[charge.amount] = charge.rideID
+	}
+	unresolvedPending := []expectedCharge{}
+	for _, charge := range pending {
+		if _, ok := takeByKey(charge.idempotencyKey); !ok {
+			unresolvedPending = append(unresolvedPending, charge)
+		}
+	}
+
+	// 金額ごとの決済 ID。actual の順 (古い順) に対応させる
+	remainingActual := map[int][]string{}
+	for i, charge := range actual {
+		if used[i] {
+			continue
+		}
+		remainingActual[charge.amount] = append(remainingActual[charge.amount], charge.paymentID)
+	}
+
+	// 金額が一致するものを消していく
+	unmatchedExpected := []expectedCharge{}
+	for _, charge := range unresolvedExpected {
+		if len(remainingActual[charge.amount]) > 0 {
+			remainingActual[charge.amount] = remainingActual[charge.amount][1:]
+			matchedRideByAmount[charge.amount] = charge.rideID
+			continue
+		}
+		unmatchedExpected = append(unmatchedExpected, charge)
+	}
+	// 送信中のライドの分がすでに届いているなら、それも消す
+	for _, charge := range unresolvedPending {
+		if len(remainingActual[charge.amount]) > 0 {
+			remainingActual[charge.amount] = remainingActual[charge.amount][1:]
+		}
+	}
+
+	unmatchedActual := []gatewayCharge{}
+	amounts := make([]int, 0, len(remainingActual))
+	for amount := range remainingActual {
+		amounts = append(amounts, amount)
+	}
+	sort.Ints(amounts)
+	for _, amount := range amounts {
+		for _, paymentID := range remainingActual[amount] {
+			// 一致するライドがすでに決済済みなら二重決済
+			if rideID, ok := matchedRideByAmount[amount]; ok {
+				discrepancies = append(discrepancies, paymentDiscrepancy{
+					UserID:         userID,
+					RideID:         rideID,
+					PaymentID:      paymentID,
+					Kind:           discrepancyDuplicate,
+					ExpectedAmount: &amount,
+					ActualAmount:   &amount,
+				})
+				continue
+			}
+			unmatchedActual = append(unmatchedActual, gatewayCharge{paymentID: paymentID, amount: amount})
+		}
+	}
+
+	// 残りはライドの古い順に金額違いとして対応させる
+	for i, charge := range unmatchedExpected {
+		d := paymentDiscrepancy{
+			UserID:         userID,
+			RideID:         charge.rideID,
+			ExpectedAmount: &charge.amount,
+		}
+		if i < len(unmatchedActual) {
+			d.Kind = discrepancyMismatch
+			d.PaymentID = unmatchedActual[i].paymentID
+			d.ActualAmount = &unmatchedActual[i].amount
+		} else {
+			d.Kind = discrepancyMissing
+		}
+		discrepancies = append(discrepancies, d)
+	}
+	for i := len(unmatchedExpected); i < len(unmatchedActual); i++ {
+		discrepancies = append(discrepancies, paymentDiscrepancy{
+			UserID:       userID,
+			PaymentID:    unmatchedActual[i].paymentID,
+			Kind:         discrepancyUnexpected,
+			ActualAmount: &unmatchedActual[i].amount,
+		})
+	}
+
+	return discrepancies
+}
+
+func printReconcileReport(w io.Writer, discrepancies []paymentDiscrepancy, summary reconcileSummary) {
+	counts := map[string]int{}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "KIND\tUSER_ID\tRIDE_ID\tPAYMENT_ID\tEXPECTED\tACTUAL")
+	for _, d := range discrepancies {
+		counts[d.Kind]++
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", d.Kind, d.UserID, orDash(d.RideID), orDash(d.PaymentID), formatAmount(d.ExpectedAmount), formatAmount(d.ActualAmount))
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\nchecked users: %d, discrepancies: %d (missing: %d, duplicate: %d, mismatch: %d, unexpected: %d), skipped pending rides: %d, skipped failed rides: %d, skipped refunded payments: %d\n",
+		summary.checkedUsers, len(discrepancies),
+		counts[discrepancyMissing], counts[discrepancyDuplicate], counts[discrepancyMismatch], counts[discrepancyUnexpected],
+		summary.pendingRides, summary.failedRides, summary.refundedPayments,
+	)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func formatAmount(amount *int) string {
+	if amount == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%d", *amount)
+}
+
+func saveDiscrepancies(ctx context.Context, discrepancies []paymentDiscrepancy) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, d := range discrepancies {
+		var rideID, paymentID *string
+		if d.RideID != "" {
+			rideID = &d.RideID
+		}
+		if d.PaymentID != "" {
+			paymentID = &d.PaymentID
+		}
+		if _, err := tx.ExecContext(
+			ctx,
+			`INSERT INTO payment_discrepancies (id, user_id, ride_id, payment_id, kind, expected_amount, actual_amount) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			ulid.Make().String(), d.UserID, rideID, paymentID, d.Kind, d.ExpectedAmount, d.ActualAmount,
+		); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
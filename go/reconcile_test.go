@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestComparePayments(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected []expectedCharge
+		pending  []expectedCharge
+		actual   []gatewayCharge
+		want     []string
+	}{
+		{
+			name:     "all matched",
+			expected: []expectedCharge{{rideID: "r1", amount: 1000}, {rideID: "r2", amount: 2000}},
+			actual:   []gatewayCharge{{paymentID: "p1", amount: 2000}, {paymentID: "p2", amount: 1000}},
+			want:     []string{},
+		},
+		{
+			name:     "missing",
+			expected: []expectedCharge{{rideID: "r1", amount: 1000}, {rideID: "r2", amount: 2000}},
+			actual:   []gatewayCharge{{paymentID: "p1", amount: 1000}},
+			want:     []string{"MISSING r2 - 2000 -"},
+		},
+		{
+			name:     "duplicate",
+			expected: []expectedCharge{{rideID: "r1", amount: 1000}},
+			actual:   []gatewayCharge{{paymentID: "p1", amount: 1000}, {paymentID: "p2", amount: 1000}},
+			want:     []string{"DUPLICATE r1 p2 1000 1000"},
+		},
+		{
+			name:     "mismatch",
+			expected: []expectedCharge{{rideID: "r1", amount: 1000}, {rideID: "r2", amount: 2000}},
+			actual:   []gatewayCharge{{paymentID: "p1", amount: 1000}, {paymentID: "p2", amount: 2500}},
+			want:     []string{"MISMATCH r2 p2 2000 2500"},
+		},
+		{
+			name:   "unexpected",
+			actual: []gatewayCharge{{paymentID: "p1", amount: 3000}},
+			want:   []string{"UNEXPECTED - p1 - 3000"},
+		},
+		{
+			name:     "pending ride already charged",
+			expected: []expectedCharge{{rideID: "r1", amount: 1000}},
+			pending:  []expectedCharge{{rideID: "r2", amount: 2000}},
+			actual:   []gatewayCharge{{paymentID: "p1", amount: 1000}, {paymentID: "p2", amount: 2000}},
+			want:     []string{},
+		},
+		{
+			name:     "pending ride not charged yet",
+			expected: []expectedCharge{{rideID: "r1", amount: 1000}},
+			pending:  []expectedCharge{{rideID: "r2", amount: 2000}},
+			actual:   []gatewayCharge{{paymentID: "p1", amount: 1000}},
+			want:     []string{},
+		},
+		{
+			name:     "pending ride does not hide a duplicate",
+			expected: []expectedCharge{{rideID: "r1", amount: 1000}},
+			pending:  []expectedCharge{{rideID: "r2", amount: 1000}},
+			actual:   []gatewayCharge{{paymentID: "p1", amount: 1000}, {paymentID: "p2", amount: 1000}, {paymentID: "p3", amount: 1000}},
+			want:     []string{"DUPLICATE r1 p3 1000 1000"},
+		},
+		{
+			name: "amounts swapped between rides are found by idempotency key",
+			expected: []expectedCharge{
+				{rideID: "r1", idempotencyKey: "k1", amount: 1000},
+				{rideID: "r2", idempotencyKey: "k2", amount: 2000},
+			},
+			actual: []gatewayCharge{
+				{paymentID: "p1", idempotencyKey: "k1", amount: 2000},
+				{paymentID: "p2", idempotencyKey: "k2", amount: 1000},
+			},
+			want: []string{"MISMATCH r1 p1 1000 2000", "MISMATCH r2 p2 2000 1000"},
+		},
+		{
+			name:     "pending ride takes its own payment by idempotency key",
+			expected: []expectedCharge{{rideID: "r1", idempotencyKey: "k1", amount: 1000}},
+			pending:  []expectedCharge{{rideID: "r2", idempotencyKey: "k2", amount: 1000}},
+			actual:   []gatewayCharge{{paymentID: "p1", idempotencyKey: "k2", amount: 1000}},
+			want:     []string{"MISSING r1 - 1000 -"},
+		},
+		{
+			name: "duplicate is blamed on the ride matched by idempotency key",
+			expected: []expectedCharge{
+				{rideID: "r1", idempotencyKey: "k1", amount: 1000},
+				{rideID: "r2", idempotencyKey: "k2", amount: 1500},
+			},
+			actual: []gatewayCharge{
+				{paymentID: "p1", idempotencyKey: "k1", amount: 1000},
+				{paymentID: "p2", idempotencyKey: "k2", amount: 1500},
+				{paymentID: "p3", amount: 1000},
+			},
+			want: []string{"DUPLICATE r1 p3 1000 1000"},
+		},
+	}
+
+	optionalInt := func(v *int) string {
+		if v == nil {
+			return "-"
+		}
+		return fmt.Sprint(*v)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+			for _, d := range comparePayments("u1", tt.expected, tt.pending, tt.actual) {
+				if d.UserID != "u1" {
+					t.Errorf("discrepancy %+v has user %q, want u1", d, d.UserID)
+				}
+				got = append(got, fmt.Sprintf("%s %s %s %s %s", d.Kind, orDash(d.RideID), orDash(d.PaymentID), optionalInt(d.ExpectedAmount), optionalInt(d.ActualAmount)))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("comparePayments() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+const (
+	rideStatusMatching  = "MATCHING"
+	rideStatusEnroute   = "ENROUTE"
+	rideStatusPickup    = "PICKUP"
+	rideStatusCarrying  = "CARRYING"
+	rideStatusArrived   = "ARRIVED"
+	rideStatusCompleted = "COMPLETED"
+	rideStatusCanceled  = "CANCELED"
+)
+
+var errInvalidRideStatusTransition = errors.New("invalid ride status transition")
+
+// ライドの状態遷移表。空文字はライド作成前を表す
+//
+//	MATCHING -> ENROUTE -> PICKUP -> CARRYING -> ARRIVED -> COMPLETED
+//
+// 乗車前 (MATCHING, ENROUTE, PICKUP) はキャンセルでき、ENROUTE はイスの辞退で MATCHING に戻る
+var rideStatusTransitions = map[string][]string{
+	"":                  {rideStatusMatching},
+	rideStatusMatching:  {rideStatusEnroute, rideStatusCanceled},
+	rideStatusEnroute:   {rideStatusPickup, rideStatusMatching, rideStatusCanceled},
+	rideStatusPickup:    {rideStatusCarrying, rideStatusCanceled},
+	rideStatusCarrying:  {rideStatusArrived},
+	rideStatusArrived:   {rideStatusCompleted},
+	rideStatusCompleted: {},
+	rideStatusCanceled:  {},
+}
+
+func canTransitRideStatus(from, to string) bool {
+	for _, next := range rideStatusTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// 完了またはキャンセルされたライドはもう進まない
+func isRideFinished(status string) bool {
+	return status == rideStatusCompleted || status == rideStatusCanceled
+}
+
+// transitRideStatus はライドの最新の状態から to に遷移できるか確かめてから ride_statuses に追加する
+// ride_statuses への書き込みは必ずこれを通すこと
+// 同じライドへの遷移が並行しても片方が 409 になるよう、rides の行をロックしてから最新の状態を読む
+func transitRideStatus(ctx context.Context, tx *sqlx.Tx, rideID string, to string) error {
+	var lockedID string
+	if err := tx.GetContext(ctx, &lockedID, `SELECT id FROM rides WHERE id = ? FOR UPDATE`, rideID); err != nil {
+		return err
+	}
+
+	from, err := getLatestRideStatus(ctx, tx, rideID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if !canTransitRideStatus(from, to) {
+		if from == "" {
+			from = "(none)"
+		}
+		return fmt.Errorf("%w: %s -> %s", errInvalidRideStatusTransition, from, to)
+	}
+
+	_, err = tx.ExecContext(
+		ctx,
+		`INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)`,
+		ulid.Make().String(), rideID, to,
+	)
+	return err
+}
+
+// 不正な状態遷移は 409、それ以外は 500 を返す
+func writeRideStatusError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errInvalidRideStatusTransition) {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCanTransitRideStatus(t *testing.T) {
+	allowed := map[[2]string]bool{
+		{"", rideStatusMatching}:                 true,
+		{rideStatusMatching, rideStatusEnroute}:  true,
+		{rideStatusMatching, rideStatusCanceled}: true,
+		{rideStatusEnroute, rideStatusPickup}:    true,
+		{rideStatusEnroute, rideStatusMatching}:  true,
+		{rideStatusEnroute, rideStatusCanceled}:  true,
+		{rideStatusPickup, rideStatusCarrying}:   true,
+		{rideStatusPickup, rideStatusCanceled}:   true,
+		{rideStatusCarrying, rideStatusArrived}:  true,
+		{rideStatusArrived, rideStatusCompleted}: true,
+	}
+
+	statuses := []string{
+		"",
+		rideStatusMatching,
+		rideStatusEnroute,
+		rideStatusPickup,
+		rideStatusCarrying,
+		rideStatusArrived,
+		rideStatusCompleted,
+		rideStatusCanceled,
+	}
+
+	for _, from := range statuses {
+		for _, to := range statuses {
+			want := allowed[[2]string{from, to}]
+			if got := canTransitRideStatus(from, to); got != want {
+				t.Errorf("canTransitRideStatus(%q, %q) = %v, want %v", from, to, got, want)
+			}
+		}
+	}
+}
+
+func TestCanTransitRideStatusUnknown(t *testing.T) {
+	tests := []struct {
+		from string
+		to   string
+	}{
+		{"UNKNOWN", rideStatusMatching},
+		{rideStatusMatching, "UNKNOWN"},
+		{rideStatusArrived, ""},
+	}
+	for _, tt := range tests {
+		if canTransitRideStatus(tt.from, tt.to) {
+			t.Errorf("canTransitRideStatus(%q, %q) = true, want false", tt.from, tt.to)
+		}
+	}
+}
+
+func TestIsRideFinished(t *testing.T) {
+	tests := []struct {
+		status string
+		want   bool
+	}{
+		{rideStatusMatching, false},
+		{rideStatusEnroute, false},
+		{rideStatusPickup, false},
+		{rideStatusCarrying, false},
+		{rideStatusArrived, false},
+		{rideStatusCompleted, true},
+		{rideStatusCanceled, true},
+	}
+	for _, tt := range tests {
+		if got := isRideFinished(tt.status); got != tt.want {
+			t.Errorf("isRideFinished(%q) = %v, want %v", tt.status, got, tt.want)
+		}
+	}
+}
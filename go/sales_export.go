@@ -0,0 +1,286 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	salesExportFormatCSV   = "csv"
+	salesExportFormatJSONL = "jsonl"
+)
+
+// この行数ごとにクライアントへ送り出す
+const salesExportFlushRows = 500
+
+type salesExportRecord struct {
+	RideID               string         `db:"ride_id"`
+	ChairID              string         `db:"chair_id"`
+	ChairName            string         `db:"chair_name"`
+	Model                string         `db:"model"`
+	PickupLatitude       int            `db:"pickup_latitude"`
+	PickupLongitude      int            `db:"pickup_longitude"`
+	DestinationLatitude  int            `db:"destination_latitude"`
+	DestinationLongitude int            `db:"destination_longitude"`
+	RequestedAt          time.Time      `db:"requested_at"`
+	CompletedAt          time.Time      `db:"completed_at"`
+	PaymentStatus        sql.NullString `db:"payment_status"`
+	PaidAt               sql.NullTime   `db:"paid_at"`
+	SurgePercent         int            `db:"surge_percent"`
+	BaseFare             int            `db:"base_fare"`
+	MeteredFare          int            `db:"metered_fare"`
+	SurgeFare            int            `db:"surge_fare"`
+	Discount             int            `db:"discount"`
+	TotalFare            int            `db:"total_fare"`
+	Evaluation           *int           `db:"evaluation"`
+}
+
+// 日時は他の API と同じく UNIX ミリ秒。決済が済んでいなければ paid_at は空
+type salesExportRow struct {
+	RideID               string  `json:"ride_id"`
+	ChairID              string  `json:"chair_id"`
+	ChairName            string  `json:"chair_name"`
+	Model                string  `json:"model"`
+	PickupLatitude       int     `json:"pickup_latitude"`
+	PickupLongitude      int     `json:"pickup_longitude"`
+	DestinationLatitude  int     `json:"destination_latitude"`
+	DestinationLongitude int     `json:"destination_longitude"`
+	RequestedAt          int64   `json:"requested_at"`
+	CompletedAt          int64   `json:"completed_at"`
+	PaymentStatus        *string `json:"payment_status"`
+	PaidAt               *int64  `json:"paid_at"`
+	SurgePercent         int     `json:"surge_percent"`
+	BaseFare             int     `json:"base_fare"`
+	MeteredFare          int     `json:"metered_fare"`
+	SurgeFare            int     `json:"surge_fare"`
+	Discount             int     `json:"discount"`
+	TotalFare            int     `json:"total_fare"`
+	Evaluation           *int    `json:"evaluation"`
+}
+
+var salesExportCSVHeader = []string{
+	"ride_id", "chair_id", "chair_name", "model",
+	"pickup_latitude", "pickup_longitude", "destination_latitude", "destination_longitude",
+	"requested_at", "completed_at", "payment_status", "paid_at",
+	"surge_percent", "base_fare", "metered_fare", "surge_fare", "discount", "total_fare", "evaluation",
+}
+
+func newSalesExportRow(record *salesExportRecord) salesExportRow {
+	row := salesExportRow{
+		RideID:               record.RideID,
+		ChairID:              record.ChairID,
+		ChairName:            record.ChairName,
+		Model:                record.Model,
+		PickupLatitude:       record.PickupLatitude,
+		PickupLongitude:      record.PickupLongitude,
+		DestinationLatitude:  record.DestinationLatitude,
+		DestinationLongitude: record.DestinationLongitude,
+		RequestedAt:          record.RequestedAt.UnixMilli(),
+		CompletedAt:          record.CompletedAt.UnixMilli(),
+		SurgePercent:         record.SurgePercent,
+		BaseFare:             record.BaseFare,
+		MeteredFare:          record.MeteredFare,
+		SurgeFare:            record.SurgeFare,
+		Discount:             record.Discount,
+		TotalFare:            record.TotalFare,
+		Evaluation:           record.Evaluation,
+	}
+	if record.PaymentStatus.Valid {
+		row.PaymentStatus = &record.PaymentStatus.String
+	}
+	if record.PaidAt.Valid {
+		paidAt := record.PaidAt.Time.UnixMilli()
+		row.PaidAt = &paidAt
+	}
+	return row
+}
+
+func (row *salesExportRow) csvRecord() []string {
+	optionalInt := func(v *int) string {
+		if v == nil {
+			return ""
+		}
+		return strconv.Itoa(*v)
+	}
+	paymentStatus := ""
+	if row.PaymentStatus != nil {
+		paymentStatus = *row.PaymentStatus
+	}
+	paidAt := ""
+	if row.PaidAt != nil {
+		paidAt = strconv.FormatInt(*row.PaidAt, 10)
+	}
+	return []string{
+		row.RideID, row.ChairID, row.ChairName, row.Model,
+		strconv.Itoa(row.PickupLatitude), strconv.Itoa(row.PickupLongitude),
+		strconv.Itoa(row.DestinationLatitude), strconv.Itoa(row.DestinationLongitude),
+		strconv.FormatInt(row.RequestedAt, 10), strconv.FormatInt(row.CompletedAt, 10), paymentStatus, paidAt,
+		strconv.Itoa(row.SurgePercent), strconv.Itoa(row.BaseFare), strconv.Itoa(row.MeteredFare),
+		strconv.Itoa(row.SurgeFare), strconv.Itoa(row.Discount), strconv.Itoa(row.TotalFare),
+		optionalInt(row.Evaluation),
+	}
+}
+
+// salesExportWriter は形式ごとに1行ずつ書き出す
+type salesExportWriter interface {
+	writeHeader() error
+	writeRow(row *salesExportRow) error
+	flush() error
+}
+
+type csvSalesExportWriter struct {
+	w *csv.Writer
+}
+
+func (e *csvSalesExportWriter) writeHeader() error {
+	return e.w.Write(salesExportCSVHeader)
+}
+
+func (e *csvSalesExportWriter) writeRow(row *salesExportRow) error {
+	return e.w.Write(row.csvRecord())
+}
+
+func (e *csvSalesExportWriter) flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type jsonlSalesExportWriter struct {
+	enc *json.Encoder
+}
+
+func (e *jsonlSalesExportWriter) writeHeader() error {
+	return nil
+}
+
+func (e *jsonlSalesExportWriter) writeRow(row *salesExportRow) error {
+	return e.enc.Encode(row)
+}
+
+func (e *jsonlSalesExportWriter) flush() error {
+	return nil
+}
+
+func newSalesExportWriter(format string, w io.Writer) (salesExportWriter, string, error) {
+	switch format {
+	case salesExportFormatCSV:
+		return &csvSalesExportWriter{w: csv.NewWriter(w)}, "text/csv; charset=utf-8", nil
+	case salesExportFormatJSONL:
+		return &jsonlSalesExportWriter{enc: json.NewEncoder(w)}, "application/x-ndjson", nil
+	default:
+		return nil, "", errors.New("format must be csv or jsonl")
+	}
+}
+
+// ownerGetSalesExport は完了したライドを1行ずつ書き出す
+// 期間の絞り込みは ownerGetSales と同じなので、total_fare の合計は売上と一致する
+// 行は DB から読んだそばから送り出すので、イスやライドの数によらずメモリ使用量は一定
+func ownerGetSalesExport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	since, until, err := parseSinceUntil(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = salesExportFormatCSV
+	}
+	exporter, contentType, err := newSalesExportWriter(format, w)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+
+	rows, err := db.QueryxContext(
+		ctx,
+		`SELECT rides.id AS ride_id,
+		        chairs.id AS chair_id,
+		        chairs.name AS chair_name,
+		        chairs.model AS model,
+		        rides.pickup_latitude,
+		        rides.pickup_longitude,
+		        rides.destination_latitude,
+		        rides.destination_longitude,
+		        rides.created_at AS requested_at,
+		        ride_statuses.created_at AS completed_at,
+		        payments.status AS payment_status,
+		        CASE WHEN payments.status = 'SUCCEEDED' THEN payments.updated_at END AS paid_at,
+		        rides.surge_percent,
+		        rides.base_fare,
+		        rides.metered_fare,
+		        rides.surge_fare,
+		        rides.discount,
+		        rides.total_fare,
+		        rides.evaluation
+		FROM rides
+		JOIN chairs ON chairs.id = rides.chair_id
+		JOIN ride_statuses ON ride_statuses.ride_id = rides.id AND ride_statuses.status = 'COMPLETED'
+		LEFT JOIN payments ON payments.ride_id = rides.id
+		WHERE chairs.owner_id = ?
+		  AND rides.updated_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND
+		ORDER BY rides.updated_at, rides.id`,
+		owner.ID, since, until,
+	)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer rows.Close()
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="sales.`+format+`"`)
+	w.WriteHeader(http.StatusOK)
+
+	// ヘッダーは送信済みなので、途中で失敗したら切断して不完全なことをクライアントに知らせる
+	abort := func(err error) {
+		if ctx.Err() == nil {
+			slog.Error("sales export aborted", slog.String("owner_id", owner.ID), slog.Any("error", err))
+		}
+		panic(http.ErrAbortHandler)
+	}
+
+	if err := exporter.writeHeader(); err != nil {
+		abort(err)
+	}
+	record := &salesExportRecord{}
+	n := 0
+	for rows.Next() {
+		*record = salesExportRecord{}
+		if err := rows.StructScan(record); err != nil {
+			abort(err)
+		}
+		row := newSalesExportRow(record)
+		if err := exporter.writeRow(&row); err != nil {
+			abort(err)
+		}
+		n++
+		if n%salesExportFlushRows == 0 {
+			if err := exporter.flush(); err != nil {
+				abort(err)
+			}
+			flusher.Flush()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		abort(err)
+	}
+	if err := exporter.flush(); err != nil {
+		abort(err)
+	}
+	flusher.Flush()
+}
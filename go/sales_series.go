@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// 売上を集計する期間の単位。週は月曜始まり
+const (
+	salesGroupByDay   = "day"
+	salesGroupByWeek  = "week"
+	salesGroupByMonth = "month"
+)
+
+const defaultSalesTimezone = "UTC"
+
+// クエリパラメータの group_by と timezone (IANA のタイムゾーン名) を読む。group_by が無ければ空文字を返す
+func parseSalesGroupBy(r *http.Request) (string, *time.Location, error) {
+	groupBy := r.URL.Query().Get("group_by")
+	switch groupBy {
+	case "", salesGroupByDay, salesGroupByWeek, salesGroupByMonth:
+	default:
+		return "", nil, fmt.Errorf("group_by must be one of %s, %s, %s", salesGroupByDay, salesGroupByWeek, salesGroupByMonth)
+	}
+
+	timezone := r.URL.Query().Get("timezone")
+	if timezone == "" {
+		timezone = defaultSalesTimezone
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid timezone: %s", timezone)
+	}
+	return groupBy, loc, nil
+}
+
+// salesBucketStart は t を含む期間の開始時刻を loc の暦で求める
+func salesBucketStart(t time.Time, groupBy string, loc *time.Location) time.Time {
+	t = t.In(loc)
+	switch groupBy {
+	case salesGroupByWeek:
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	case salesGroupByMonth:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
+	default:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	}
+}
+
+func salesBucketLabel(start time.Time, groupBy string) string {
+	if groupBy == salesGroupByMonth {
+		return start.Format("2006-01")
+	}
+	return start.Format("2006-01-02")
+}
+
+// salesBucket は1期間分の集計。sales は実際に支払われた額、gross_fare はクーポン適用前の運賃
+type salesBucket struct {
+	Label             string  `json:"label"`
+	StartAt           int64   `json:"start_at"`
+	Rides             int     `json:"rides"`
+	GrossFare         int     `json:"gross_fare"`
+	Discount          int     `json:"discount"`
+	Sales             int     `json:"sales"`
+	AverageEvaluation float64 `json:"average_evaluation"`
+}
+
+type salesBucketTotal struct {
+	start           time.Time
+	rides           int
+	grossFare       int
+	discount        int
+	sales           int
+	evaluationSum   int
+	evaluationCount int
+}
+
+// salesSeries はライドを期間ごとに集計する。ライドが無い期間は含めない
+type salesSeries struct {
+	groupBy string
+	loc     *time.Location
+	buckets map[time.Time]*salesBucketTotal
+}
+
+func newSalesSeries(groupBy string, loc *time.Location) *salesSeries {
+	return &salesSeries{groupBy: groupBy, loc: loc, buckets: map[time.Time]*salesBucketTotal{}}
+}
+
+// 完了したライドは最後に更新された日時 (評価日時) の期間に数える
+func (s *salesSeries) add(ride Ride) {
+	start := salesBucketStart(ride.UpdatedAt, s.groupBy, s.loc)
+	b, ok := s.buckets[start]
+	if !ok {
+		b = &salesBucketTotal{start: start}
+		s.buckets[start] = b
+	}
+	b.rides++
+	b.grossFare += ride.TotalFare + ride.Discount
+	b.discount += ride.Discount
+	b.sales += calculateSale(ride)
+	if ride.Evaluation != nil {
+		b.evaluationSum += *ride.Evaluation
+		b.evaluationCount++
+	}
+}
+
+func (s *salesSeries) result() []salesBucket {
+	totals := make([]*salesBucketTotal, 0, len(s.buckets))
+	for _, b := range s.buckets {
+		totals = append(totals, b)
+	}
+	slices.SortFunc(totals, func(a, b *salesBucketTotal) int {
+		return a.start.Compare(b.start)
+	})
+
+	result := make([]salesBucket, 0, len(totals))
+	for _, b := range totals {
+		bucket := salesBucket{
+			Label:     salesBucketLabel(b.start, s.groupBy),
+			StartAt:   b.start.UnixMilli(),
+			Rides:     b.rides,
+			GrossFare: b.grossFare,
+			Discount:  b.discount,
+			Sales:     b.sales,
+		}
+		if b.evaluationCount > 0 {
+			bucket.AverageEvaluation = float64(b.evaluationSum) / float64(b.evaluationCount)
+		}
+		result = append(result, bucket)
+	}
+	return result
+}
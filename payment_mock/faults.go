@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// 障害なし
+	faultModeNone = "none"
+	// 5xx を返し、決済も記録しない
+	faultModeError = "error"
+	// 決済は記録したうえで 5xx を返す (エラーだが実際は成功しているケース)
+	faultModeErrorAfterCommit = "error_after_commit"
+	// レスポンスを返さずにクライアントのタイムアウトを待つ
+	faultModeTimeout = "timeout"
+)
+
+// faultConfig は POST /payments に注入する障害の設定
+type faultConfig struct {
+	Mode string `json:"mode"`
+	// Mode の障害を起こす確率 (0〜1)
+	Rate float64 `json:"rate"`
+	// すべてのリクエストに追加する遅延
+	LatencyMs int `json:"latency_ms"`
+	// 1秒あたりに受け付けるリクエスト数。超えたら 429 を返す。0 なら無制限
+	RateLimit int `json:"rate_limit"`
+}
+
+func (c faultConfig) validate() error {
+	switch c.Mode {
+	case faultModeNone, faultModeError, faultModeErrorAfterCommit, faultModeTimeout:
+	default:
+		return fmt.Errorf("unknown fault mode: %s", c.Mode)
+	}
+	if c.Rate < 0 || c.Rate > 1 {
+		return errors.New("rate must be between 0 and 1")
+	}
+	if c.LatencyMs < 0 {
+		return errors.New("latency_ms must not be negative")
+	}
+	if c.RateLimit < 0 {
+		return errors.New("rate_limit must not be negative")
+	}
+	return nil
+}
+
+var (
+	faults     = faultConfig{Mode: faultModeNone}
+	faultsLock sync.RWMutex
+
+	rateLimitWindow time.Time
+	rateLimitCount  int
+	rateLimitLock   sync.Mutex
+)
+
+// timeout モードでレスポンスを返さずに待つ最大時間
+const faultTimeoutDuration = 30 * time.Second
+
+// フラグと環境変数から初期設定を読む。フラグが優先される
+// flag.Parse の前に呼ぶこと
+func registerFaultFlags() *faultConfig {
+	c := &faultConfig{
+		Mode:      envOr("PAYMENT_MOCK_FAULT_MODE", faultModeNone),
+		Rate:      envFloat("PAYMENT_MOCK_FAULT_RATE", 1),
+		LatencyMs: envInt("PAYMENT_MOCK_LATENCY_MS", 0),
+		RateLimit: envInt("PAYMENT_MOCK_RATE_LIMIT", 0),
+	}
+	flag.StringVar(&c.Mode, "fault-mode", c.Mode, "fault mode (none, error, error_after_commit, timeout)")
+	flag.Float64Var(&c.Rate, "fault-rate", c.Rate, "probability of injecting the fault (0-1)")
+	flag.IntVar(&c.LatencyMs, "latency-ms", c.LatencyMs, "latency added to every POST /payments")
+	flag.IntVar(&c.RateLimit, "rate-limit", c.RateLimit, "max POST /payments per second before returning 429 (0 = unlimited)")
+	return c
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func envFloat(key string, def float64) float64 {
+	v, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+func envInt(key string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+func currentFaults() faultConfig {
+	faultsLock.RLock()
+	defer faultsLock.RUnlock()
+	return faults
+}
+
+func setFaults(c faultConfig) {
+	faultsLock.Lock()
+	faults = c
+	faultsLock.Unlock()
+	slog.Info("障害設定を変更", slog.String("mode", c.Mode), slog.Float64("rate", c.Rate), slog.Int("latency_ms", c.LatencyMs), slog.Int("rate_limit", c.RateLimit))
+}
+
+// 1秒ごとの固定ウィンドウでリクエスト数を数える
+func rateLimited(limit int) bool {
+	if limit <= 0 {
+		return false
+	}
+	rateLimitLock.Lock()
+	defer rateLimitLock.Unlock()
+	now := time.Now().Truncate(time.Second)
+	if !now.Equal(rateLimitWindow) {
+		rateLimitWindow = now
+		rateLimitCount = 0
+	}
+	rateLimitCount++
+	return rateLimitCount > limit
+}
+
+// injectFaults は決済を記録する前に呼ばれ、今回のリクエストで起こす障害のモードを返す
+// リクエストの処理がここで終わった場合は handled が true になる
+func injectFaults(w http.ResponseWriter, r *http.Request) (mode string, handled bool) {
+	c := currentFaults()
+
+	if c.LatencyMs > 0 {
+		select {
+		case <-time.After(time.Duration(c.LatencyMs) * time.Millisecond):
+		case <-r.Context().Done():
+			return faultModeNone, true
+		}
+	}
+
+	if rateLimited(c.RateLimit) {
+		w.Header().Set("Retry-After", "1")
+		writeJSON(w, http.StatusTooManyRequests, map[string]string{"message": "リクエストが多すぎます"})
+		return faultModeNone, true
+	}
+
+	if c.Mode == faultModeNone || rand.Float64() >= c.Rate {
+		return faultModeNone, false
+	}
+
+	switch c.Mode {
+	case faultModeError:
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"message": "決済サービスで障害が発生しています"})
+		return c.Mode, true
+	case faultModeTimeout:
+		select {
+		case <-time.After(faultTimeoutDuration):
+			writeJSON(w, http.StatusGatewayTimeout, map[string]string{"message": "タイムアウトしました"})
+		case <-r.Context().Done():
+		}
+		return c.Mode, true
+	}
+	return c.Mode, false
+}
+
+func handleGetFaults(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, currentFaults())
+}
+
+func handlePutFaults(w http.ResponseWriter, r *http.Request) {
+	c := currentFaults()
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "不正なリクエスト形式です"})
+		return
+	}
+	if err := c.validate(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+		return
+	}
+	setFaults(c)
+	writeJSON(w, http.StatusOK, c)
+}
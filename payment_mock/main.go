@@ -2,22 +2,49 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"os"
 	"strings"
 	"sync"
+	"time"
 )
 
 var (
-	data     = map[string][]int{}
+	data     *store
 	dataLock sync.Mutex
+	// 処理中の Idempotency-Key (token + key)
+	inflightKeys = map[string]struct{}{}
 )
 
 func main() {
+	dataFile := flag.String("data-file", envOr("PAYMENT_MOCK_DATA_FILE", "payments.jsonl"), "file to persist payments to (empty = in-memory only)")
+	c := registerFaultFlags()
+	flag.Parse()
+	if err := c.validate(); err != nil {
+		slog.Error(err.Error())
+		os.Exit(2)
+	}
+	setFaults(*c)
+
+	s, err := loadStore(*dataFile)
+	if err != nil {
+		slog.Error("決済データの読み込みに失敗しました", slog.Any("error", err))
+		os.Exit(1)
+	}
+	data = s
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /payments", handleGetPayments)
 	mux.HandleFunc("POST /payments", handlePostPayments)
+	mux.HandleFunc("POST /payments/{id}/refund", handlePostPaymentRefund)
+
+	// 障害注入の設定を実行中に変更する
+	mux.HandleFunc("GET /admin/faults", handleGetFaults)
+	mux.HandleFunc("PUT /admin/faults", handlePutFaults)
+
 	http.ListenAndServe(":12345", mux)
 }
 
@@ -38,28 +65,94 @@ func handlePostPayments(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.Amount <= 0 && req.Amount > 1_000_000 {
+	if req.Amount <= 0 || req.Amount > 1_000_000 {
 		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "決済額が不正です"})
 		return
 	}
 
+	// Idempotency-Key が同じ決済は二重に記録しない
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey != "" {
+		inflightKey := token + "\x00" + idempotencyKey
+		dataLock.Lock()
+		if p := data.findByIdempotencyKey(token, idempotencyKey); p != nil {
+			dataLock.Unlock()
+			if p.Amount != req.Amount {
+				writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"message": "同じIdempotency-Keyで異なる決済が要求されました"})
+				return
+			}
+			slog.Info("決済済み", slog.String("token", token), slog.String("idempotency_key", idempotencyKey))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if _, ok := inflightKeys[inflightKey]; ok {
+			dataLock.Unlock()
+			writeJSON(w, http.StatusConflict, map[string]string{"message": "同じIdempotency-Keyの決済が処理中です"})
+			return
+		}
+		inflightKeys[inflightKey] = struct{}{}
+		dataLock.Unlock()
+
+		defer func() {
+			dataLock.Lock()
+			delete(inflightKeys, inflightKey)
+			dataLock.Unlock()
+		}()
+	}
+
+	mode, handled := injectFaults(w, r)
+	if handled {
+		return
+	}
+
 	// モックサーバーは任意のトークンを受け付けて、決済を記録する
-	dataLock.Lock()
-	arr, ok := data[token]
-	if !ok {
-		arr = []int{}
-		data[token] = arr
+	p := &payment{
+		ID:             newPaymentID(),
+		Amount:         req.Amount,
+		Status:         paymentStatusSucceeded,
+		IdempotencyKey: idempotencyKey,
+		CreatedAt:      time.Now(),
 	}
-	arr = append(arr, req.Amount)
+	dataLock.Lock()
+	err = data.add(token, p)
 	dataLock.Unlock()
+	if err != nil {
+		slog.Error("決済の保存に失敗しました", slog.Any("error", err))
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"message": "決済の保存に失敗しました"})
+		return
+	}
+
+	slog.Info("決済完了", slog.String("token", token), slog.String("id", p.ID), slog.Int("amount", req.Amount))
 
-	slog.Info("決済完了", slog.String("token", token), slog.Int("amount", req.Amount))
+	if mode == faultModeErrorAfterCommit {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"message": "決済サービスで障害が発生しています"})
+		return
+	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
 type ResponsePayment struct {
-	Amount int    `json:"amount"`
-	Status string `json:"status"`
+	ID             string `json:"id"`
+	Amount         int    `json:"amount"`
+	Status         string `json:"status"`
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	CreatedAt      int64  `json:"created_at"`
+	RefundedAt     *int64 `json:"refunded_at,omitempty"`
+}
+
+func newResponsePayment(p *payment) ResponsePayment {
+	res := ResponsePayment{
+		ID:             p.ID,
+		Amount:         p.Amount,
+		Status:         p.Status,
+		IdempotencyKey: p.IdempotencyKey,
+		CreatedAt:      p.CreatedAt.UnixMilli(),
+	}
+	if p.RefundedAt != nil {
+		t := p.RefundedAt.UnixMilli()
+		res.RefundedAt = &t
+	}
+	return res
 }
 
 func handleGetPayments(w http.ResponseWriter, r *http.Request) {
@@ -70,19 +163,47 @@ func handleGetPayments(w http.ResponseWriter, r *http.Request) {
 	}
 
 	dataLock.Lock()
-	arr, _ := data[token]
-	dataLock.Unlock()
-
+	arr := data.Payments[token]
 	res := make([]ResponsePayment, 0, len(arr))
-	for _, amount := range arr {
-		res = append(res, ResponsePayment{
-			Amount: amount,
-			Status: "成功",
-		})
+	for _, p := range arr {
+		res = append(res, newResponsePayment(p))
 	}
+	dataLock.Unlock()
+
 	writeJSON(w, http.StatusOK, res)
 }
 
+func handlePostPaymentRefund(w http.ResponseWriter, r *http.Request) {
+	token, err := getTokenFromAuthorizationHeader(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+		return
+	}
+	id := r.PathValue("id")
+
+	dataLock.Lock()
+	defer dataLock.Unlock()
+
+	p := data.find(token, id)
+	if p == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "決済が見つかりません"})
+		return
+	}
+	if p.Status == paymentStatusRefunded {
+		writeJSON(w, http.StatusConflict, map[string]string{"message": "すでに返金されています"})
+		return
+	}
+
+	if err := data.refund(token, p, time.Now()); err != nil {
+		slog.Error("返金の保存に失敗しました", slog.Any("error", err))
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"message": "返金の保存に失敗しました"})
+		return
+	}
+
+	slog.Info("返金完了", slog.String("token", token), slog.String("id", p.ID), slog.Int("amount", p.Amount))
+	writeJSON(w, http.StatusOK, newResponsePayment(p))
+}
+
 func getTokenFromAuthorizationHeader(r *http.Request) (string, error) {
 	auth := r.Header.Get("Authorization")
 	if !strings.HasPrefix(auth, "Bearer ") {
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	paymentStatusSucceeded = "成功"
+	paymentStatusRefunded  = "返金済み"
+)
+
+type payment struct {
+	ID             string     `json:"id"`
+	Amount         int        `json:"amount"`
+	Status         string     `json:"status"`
+	IdempotencyKey string     `json:"idempotency_key,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	RefundedAt     *time.Time `json:"refunded_at,omitempty"`
+}
+
+// store はトークンごとの決済の一覧
+// 変更は1件ずつファイルの末尾に追記し、起動時に先頭から再生して復元する
+// dataLock を取ってから操作すること
+type store struct {
+	file     *os.File
+	size     int64
+	Payments map[string][]*payment
+}
+
+// storeRecord はファイルに追記する1行。op が add なら payment を、refund なら id と refunded_at を持つ
+type storeRecord struct {
+	Op         string     `json:"op"`
+	Token      string     `json:"token"`
+	Payment    *payment   `json:"payment,omitempty"`
+	ID         string     `json:"id,omitempty"`
+	RefundedAt *time.Time `json:"refunded_at,omitempty"`
+}
+
+const (
+	storeOpAdd    = "add"
+	storeOpRefund = "refund"
+)
+
+func newPaymentID() string {
+	b := make([]byte, 13)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%x", b)
+}
+
+// loadStore はファイルから決済を読み込み、以降の変更を追記できるように開いておく。path が空ならメモリ上だけで保持する
+func loadStore(path string) (*store, error) {
+	s := &store{Payments: map[string][]*payment{}}
+	if path == "" {
+		return s, nil
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(f)
+	// 書き込み途中で落ちた最後の行は捨てる
+	var validSize int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		var rec storeRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		s.apply(&rec)
+		validSize += int64(len(line))
+	}
+	if err := f.Truncate(validSize); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(validSize, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	s.file = f
+	s.size = validSize
+	return s, nil
+}
+
+func (s *store) apply(rec *storeRecord) {
+	switch rec.Op {
+	case storeOpAdd:
+		s.Payments[rec.Token] = append(s.Payments[rec.Token], rec.Payment)
+	case storeOpRefund:
+		if p := s.find(rec.Token, rec.ID); p != nil {
+			p.Status = paymentStatusRefunded
+			p.RefundedAt = rec.RefundedAt
+		}
+	}
+}
+
+// append は1行だけ書き足す。ファイル全体を書き直さないので、決済が増えてもロックを握る時間は変わらない
+func (s *store) append(rec *storeRecord) error {
+	if s.file == nil {
+		return nil
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(append(b, '\n')); err != nil {
+		// 書きかけの行を残すと次の行までつながって読めなくなる
+		if terr := s.file.Truncate(s.size); terr == nil {
+			s.file.Seek(s.size, io.SeekStart)
+		}
+		return err
+	}
+	s.size += int64(len(b)) + 1
+	return nil
+}
+
+func (s *store) findByIdempotencyKey(token, key string) *payment {
+	if key == "" {
+		return nil
+	}
+	for _, p := range s.Payments[token] {
+		if p.IdempotencyKey == key {
+			return p
+		}
+	}
+	return nil
+}
+
+func (s *store) find(token, id string) *payment {
+	for _, p := range s.Payments[token] {
+		if p.ID == id {
+			return p
+		}
+	}
+	return nil
+}
+
+func (s *store) add(token string, p *payment) error {
+	if err := s.append(&storeRecord{Op: storeOpAdd, Token: token, Payment: p}); err != nil {
+		return err
+	}
+	s.Payments[token] = append(s.Payments[token], p)
+	return nil
+}
+
+func (s *store) refund(token string, p *payment, refundedAt time.Time) error {
+	if err := s.append(&storeRecord{Op: storeOpRefund, Token: token, ID: p.ID, RefundedAt: &refundedAt}); err != nil {
+		return err
+	}
+	p.Status = paymentStatusRefunded
+	p.RefundedAt = &refundedAt
+	return nil
+}
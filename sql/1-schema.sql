@@ -15,8 +15,9 @@ CREATE TABLE settings
 DROP TABLE IF EXISTS chair_models;
 CREATE TABLE chair_models
 (
-  name  VARCHAR(50) NOT NULL COMMENT '椅子モデル名',
-  speed INTEGER     NOT NULL COMMENT '移動速度',
+  name               VARCHAR(50) NOT NULL COMMENT '椅子モデル名',
+  speed              INTEGER     NOT NULL COMMENT '移動速度',
+  commission_percent INTEGER     NOT NULL DEFAULT 10 COMMENT 'プラットフォーム手数料率(%)',
   PRIMARY KEY (name)
 )
   COMMENT = '椅子モデルテーブル';
@@ -34,6 +35,9 @@ CREATE TABLE chairs
   location_lon              INTEGER          NULL COMMENT '椅子の現在位置(緯度)',
   total_distance            INTEGER      NOT NULL DEFAULT 0 COMMENT '椅子の総移動距離合計',
   total_distance_updated_at DATETIME(6)      NULL COMMENT '椅子の総距離合計の更新日時',
+  is_online                 TINYINT(1)   NOT NULL DEFAULT 1 COMMENT 'リクエストが途絶えていないか',
+  last_seen_at              DATETIME(6)      NULL COMMENT '最後にリクエストを受けた日時',
+  deleted_at                DATETIME(6)      NULL COMMENT '退役日時',
   created_at                DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
   updated_at                DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6) COMMENT '更新日時',
   PRIMARY KEY (id),
@@ -57,6 +61,26 @@ CREATE TABLE chair_locations
 
 CREATE INDEX idx_chairlocations_chairid_createdat ON chair_locations(chair_id, created_at DESC);
 
+DROP TABLE IF EXISTS chair_movement_anomalies;
+CREATE TABLE chair_movement_anomalies
+(
+  id             VARCHAR(26)                   NOT NULL,
+  chair_id       VARCHAR(26)                   NOT NULL COMMENT '椅子ID',
+  from_latitude  INTEGER                       NOT NULL COMMENT '移動前の経度',
+  from_longitude INTEGER                       NOT NULL COMMENT '移動前の緯度',
+  to_latitude    INTEGER                       NOT NULL COMMENT '移動後の経度',
+  to_longitude   INTEGER                       NOT NULL COMMENT '移動後の緯度',
+  distance       INTEGER                       NOT NULL COMMENT '移動距離',
+  elapsed_ms     BIGINT                        NOT NULL COMMENT '前回の座標からの経過時間(ミリ秒)',
+  max_distance   INTEGER                       NOT NULL COMMENT '経過時間と速度から許容される最大の移動距離',
+  action         ENUM ('FLAGGED', 'REJECTED')  NOT NULL COMMENT '記録だけしたか、座標を拒否したか',
+  created_at     DATETIME(6)                   NOT NULL COMMENT '移動後の座標の日時',
+  PRIMARY KEY (id)
+)
+  COMMENT = '椅子の不自然な移動の記録テーブル';
+
+CREATE INDEX idx_chairmovementanomalies_chairid_createdat ON chair_movement_anomalies(chair_id, created_at);
+
 DROP TABLE IF EXISTS users;
 CREATE TABLE users
 (
@@ -97,6 +121,14 @@ CREATE TABLE rides
   destination_latitude  INTEGER     NOT NULL COMMENT '目的地(経度)',
   destination_longitude INTEGER     NOT NULL COMMENT '目的地(緯度)',
   evaluation            INTEGER     NULL     COMMENT '評価',
+  surge_percent         INTEGER     NOT NULL DEFAULT 100 COMMENT 'ライド作成時に確定したサージ倍率(%)',
+  base_fare             INTEGER     NOT NULL DEFAULT 0 COMMENT '初乗り運賃',
+  metered_fare          INTEGER     NOT NULL DEFAULT 0 COMMENT '距離に応じた運賃',
+  surge_fare            INTEGER     NOT NULL DEFAULT 0 COMMENT 'サージによる追加運賃',
+  discount              INTEGER     NOT NULL DEFAULT 0 COMMENT 'クーポンによる割引額',
+  total_fare            INTEGER     NOT NULL DEFAULT 0 COMMENT 'ライド作成時に確定した請求額',
+  trace_started_at      DATETIME(6) NULL     COMMENT '椅子の移動履歴のうちこのライドの区間の開始日時(ENROUTE)',
+  trace_ended_at        DATETIME(6) NULL     COMMENT '椅子の移動履歴のうちこのライドの区間の終了日時(ARRIVED)',
   created_at            DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '要求日時',
   updated_at            DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6) COMMENT '状態更新日時',
   PRIMARY KEY (id)
@@ -109,12 +141,12 @@ CREATE INDEX idx_rides_userid_createdat ON rides(user_id, created_at DESC);
 DROP TABLE IF EXISTS ride_statuses;
 CREATE TABLE ride_statuses
 (
-  id              VARCHAR(26)                                                                NOT NULL,
-  ride_id VARCHAR(26)                                                                        NOT NULL COMMENT 'ライドID',
-  status          ENUM ('MATCHING', 'ENROUTE', 'PICKUP', 'CARRYING', 'ARRIVED', 'COMPLETED') NOT NULL COMMENT '状態',
-  created_at      DATETIME(6)                                                                NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '状態変更日時',
-  app_sent_at     DATETIME(6)                                                                NULL COMMENT 'ユーザーへの状態通知日時',
-  chair_sent_at   DATETIME(6)                                                                NULL COMMENT '椅子への状態通知日時',
+  id              VARCHAR(26)                                                                            NOT NULL,
+  ride_id VARCHAR(26)                                                                                    NOT NULL COMMENT 'ライドID',
+  status          ENUM ('MATCHING', 'ENROUTE', 'PICKUP', 'CARRYING', 'ARRIVED', 'COMPLETED', 'CANCELED') NOT NULL COMMENT '状態',
+  created_at      DATETIME(6)                                                                            NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '状態変更日時',
+  app_sent_at     DATETIME(6)                                                                            NULL COMMENT 'ユーザーへの状態通知日時',
+  chair_sent_at   DATETIME(6)                                                                            NULL COMMENT '椅子への状態通知日時',
   PRIMARY KEY (id)
 )
   COMMENT = 'ライドステータスの変更履歴テーブル';
@@ -138,17 +170,154 @@ CREATE TABLE owners
 )
   COMMENT = '椅子のオーナー情報テーブル';
 
+DROP TABLE IF EXISTS campaigns;
+CREATE TABLE campaigns
+(
+  id                  VARCHAR(26)                             NOT NULL COMMENT 'キャンペーンID',
+  name                VARCHAR(255)                            NOT NULL COMMENT 'キャンペーン名',
+  grant_on            ENUM ('SIGNUP', 'INVITEE', 'INVITER')   NOT NULL COMMENT 'クーポンを付与する契機',
+  code                VARCHAR(255)                            NOT NULL COMMENT 'クーポンコード (招待系は接頭辞)',
+  discount_type       ENUM ('FIXED', 'PERCENTAGE')            NOT NULL COMMENT '割引の種類',
+  discount_amount     INTEGER                                 NOT NULL COMMENT '割引額 (PERCENTAGE の場合は上限額)',
+  discount_percent    INTEGER                                 NULL COMMENT '割引率(%)',
+  per_user_limit      INTEGER                                 NULL COMMENT '1ユーザーに付与するクーポン数の上限',
+  per_code_limit      INTEGER                                 NULL COMMENT '同じコードで付与するクーポン数の上限 (招待コードごとの招待数など)',
+  valid_days          INTEGER                                 NULL COMMENT '付与したクーポンの有効日数 (NULL なら無期限)',
+  first_ride_priority TINYINT(1)                              NOT NULL DEFAULT 0 COMMENT '初回利用時に優先して使うか',
+  starts_at           DATETIME(6)                             NULL COMMENT '付与開始日時',
+  ends_at             DATETIME(6)                             NULL COMMENT '付与終了日時',
+  created_at          DATETIME(6)                             NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '作成日時',
+  PRIMARY KEY (id),
+  UNIQUE (code)
+)
+  COMMENT 'クーポンキャンペーンテーブル';
+
 DROP TABLE IF EXISTS coupons;
 CREATE TABLE coupons
 (
-  user_id    VARCHAR(26)  NOT NULL COMMENT '所有しているユーザーのID',
-  code       VARCHAR(255) NOT NULL COMMENT 'クーポンコード',
-  discount   INTEGER      NOT NULL COMMENT '割引額',
-  created_at DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '付与日時',
-  used_by    VARCHAR(26)  NULL COMMENT 'クーポンが適用されたライドのID',
+  user_id          VARCHAR(26)  NOT NULL COMMENT '所有しているユーザーのID',
+  code             VARCHAR(255) NOT NULL COMMENT 'クーポンコード',
+  campaign_id      VARCHAR(26)  NULL COMMENT '付与したキャンペーンのID',
+  discount         INTEGER      NOT NULL COMMENT '割引額 (割引率がある場合は上限額)',
+  discount_percent INTEGER      NULL COMMENT '割引率(%)',
+  created_at       DATETIME(6)  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '付与日時',
+  expires_at       DATETIME(6)  NULL COMMENT '有効期限 (NULL なら無期限)',
+  is_expired       TINYINT(1)   NOT NULL DEFAULT 0 COMMENT '期限切れとして処理済みか',
+  used_by          VARCHAR(26)  NULL COMMENT 'クーポンが適用されたライドのID',
   PRIMARY KEY (user_id, code)
 )
   COMMENT 'クーポンテーブル';
 
 CREATE INDEX idx_coupons_usedby ON coupons(used_by);
 CREATE INDEX idx_coupons_code ON coupons(code);
+CREATE INDEX idx_coupons_userid_campaignid ON coupons(user_id, campaign_id);
+CREATE INDEX idx_coupons_isexpired_expiresat ON coupons(is_expired, expires_at);
+
+DROP TABLE IF EXISTS referrals;
+CREATE TABLE referrals
+(
+  invitee_id      VARCHAR(26) NOT NULL COMMENT '招待コードを使って登録したユーザーのID',
+  inviter_id      VARCHAR(26) NOT NULL COMMENT '招待したユーザーのID',
+  invitation_code VARCHAR(30) NOT NULL COMMENT '使われた招待コード',
+  created_at      DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  PRIMARY KEY (invitee_id)
+)
+  COMMENT = '招待テーブル';
+
+CREATE INDEX idx_referrals_inviterid_createdat ON referrals(inviter_id, created_at);
+
+DROP TABLE IF EXISTS referral_rewards;
+CREATE TABLE referral_rewards
+(
+  invitee_id  VARCHAR(26)  NOT NULL COMMENT '報酬のもとになった招待のユーザーID',
+  coupon_code VARCHAR(255) NOT NULL COMMENT '招待したユーザーに付与したクーポンのコード',
+  PRIMARY KEY (invitee_id, coupon_code)
+)
+  COMMENT = '招待報酬テーブル';
+
+DROP TABLE IF EXISTS payments;
+CREATE TABLE payments
+(
+  ride_id         VARCHAR(26)                                        NOT NULL COMMENT 'ライドID',
+  user_id         VARCHAR(26)                                        NOT NULL COMMENT 'ユーザーID',
+  amount          INTEGER                                            NOT NULL COMMENT '決済額',
+  idempotency_key VARCHAR(26)                                        NOT NULL COMMENT '決済サービスに送るIdempotency-Key',
+  status          ENUM ('PENDING', 'SUCCEEDED', 'FAILED', 'UNKNOWN') NOT NULL DEFAULT 'PENDING' COMMENT '決済状態。UNKNOWN は再送しきっても結果が分からなかったもの',
+  attempts        INTEGER                                            NOT NULL DEFAULT 0 COMMENT '送信試行回数',
+  next_attempt_at DATETIME(6)                                        NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '次回送信日時',
+  last_error      TEXT                                               NULL COMMENT '最後のエラー',
+  created_at      DATETIME(6)                                        NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '登録日時',
+  updated_at      DATETIME(6)                                        NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6) COMMENT '更新日時',
+  PRIMARY KEY (ride_id),
+  UNIQUE (idempotency_key)
+)
+  COMMENT = '決済のアウトボックステーブル';
+
+CREATE INDEX idx_payments_status_nextattemptat ON payments(status, next_attempt_at);
+
+DROP TABLE IF EXISTS payment_attempts;
+CREATE TABLE payment_attempts
+(
+  id          VARCHAR(26) NOT NULL,
+  ride_id     VARCHAR(26) NOT NULL COMMENT 'ライドID',
+  attempt     INTEGER     NOT NULL COMMENT '何回目の試行か',
+  status_code INTEGER     NULL COMMENT '決済サービスのレスポンスのステータスコード',
+  error       TEXT        NULL COMMENT 'エラー内容',
+  created_at  DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '試行日時',
+  PRIMARY KEY (id)
+)
+  COMMENT = '決済サービスへの送信履歴テーブル';
+
+CREATE INDEX idx_paymentattempts_rideid ON payment_attempts(ride_id);
+
+DROP TABLE IF EXISTS payment_discrepancies;
+CREATE TABLE payment_discrepancies
+(
+  id              VARCHAR(26)                                                 NOT NULL,
+  user_id         VARCHAR(26)                                                 NOT NULL COMMENT 'ユーザーID',
+  ride_id         VARCHAR(26)                                                 NULL COMMENT 'ライドID',
+  payment_id      VARCHAR(255)                                                NULL COMMENT '決済サービスの決済ID',
+  kind            ENUM ('MISSING', 'DUPLICATE', 'MISMATCH', 'UNEXPECTED')     NOT NULL COMMENT '不整合の種類',
+  expected_amount INTEGER                                                     NULL COMMENT '請求されるべき額',
+  actual_amount   INTEGER                                                     NULL COMMENT '決済サービスに記録されている額',
+  created_at      DATETIME(6)                                                 NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '検出日時',
+  PRIMARY KEY (id)
+)
+  COMMENT = '決済の突き合わせで見つかった不整合テーブル';
+
+DROP TABLE IF EXISTS ledger_entries;
+CREATE TABLE ledger_entries
+(
+  ride_id        VARCHAR(26)                                                                  NOT NULL COMMENT 'ライドID',
+  entry_type     ENUM ('RIDER_CHARGE', 'COUPON_SUBSIDY', 'PLATFORM_FEE', 'OWNER_EARNINGS')     NOT NULL COMMENT '仕訳の種類',
+  owner_id       VARCHAR(26)                                                                  NOT NULL COMMENT 'オーナーID',
+  debit_account  VARCHAR(30)                                                                  NOT NULL COMMENT '借方勘定',
+  credit_account VARCHAR(30)                                                                  NOT NULL COMMENT '貸方勘定',
+  amount         INTEGER                                                                      NOT NULL COMMENT '金額',
+  statement_id   VARCHAR(26)                                                                  NULL COMMENT '精算明細ID',
+  created_at     DATETIME(6)                                                                  NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '計上日時',
+  PRIMARY KEY (ride_id, entry_type)
+)
+  COMMENT = '完了したライドごとの複式の仕訳テーブル';
+
+CREATE INDEX idx_ledgerentries_ownerid_statementid_createdat ON ledger_entries(owner_id, statement_id, created_at);
+CREATE INDEX idx_ledgerentries_statementid_createdat ON ledger_entries(statement_id, created_at);
+
+DROP TABLE IF EXISTS payout_statements;
+CREATE TABLE payout_statements
+(
+  id             VARCHAR(26) NOT NULL,
+  owner_id       VARCHAR(26) NOT NULL COMMENT 'オーナーID',
+  period_start   DATETIME(6) NOT NULL COMMENT '精算期間の開始日時',
+  period_end     DATETIME(6) NOT NULL COMMENT '精算期間の終了日時(この日時を含まない)',
+  rides          INTEGER     NOT NULL COMMENT 'ライド数',
+  rider_charges  INTEGER     NOT NULL COMMENT 'ユーザーへの請求額の合計',
+  coupon_subsidy INTEGER     NOT NULL COMMENT 'クーポンの補填額の合計',
+  platform_fee   INTEGER     NOT NULL COMMENT 'プラットフォーム手数料の合計',
+  owner_earnings INTEGER     NOT NULL COMMENT 'オーナーへの支払額の合計',
+  created_at     DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) COMMENT '精算日時',
+  updated_at     DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6) COMMENT '更新日時',
+  PRIMARY KEY (id),
+  UNIQUE (owner_id, period_start)
+)
+  COMMENT = 'オーナーへの精算明細テーブル';
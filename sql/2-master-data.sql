@@ -62,3 +62,9 @@ VALUES ('リラックスシート NEO', 2),
        ('タイタンフレーム ULTRA', 7),
        ('ヴァーチェア SUPREME', 7),
        ('オブシディアン PRIME', 7);
+
+-- 初回登録と招待のキャンペーン。ID は初期データのクーポンの紐付けにも使う
+INSERT INTO campaigns (id, name, grant_on, code, discount_type, discount_amount, per_user_limit, per_code_limit, first_ride_priority)
+VALUES ('01JD9Q5N3R4V6X8Z0B2C4E6G8J', '新規登録キャンペーン', 'SIGNUP', 'CP_NEW2024', 'FIXED', 3000, 1, NULL, 1),
+       ('01JD9Q5N3R4V6X8Z0B2C4E6G8K', '招待キャンペーン (招待された側)', 'INVITEE', 'INV_', 'FIXED', 1500, NULL, 3, 0),
+       ('01JD9Q5N3R4V6X8Z0B2C4E6G8M', '招待キャンペーン (招待した側)', 'INVITER', 'RWD_', 'FIXED', 1000, NULL, NULL, 0);
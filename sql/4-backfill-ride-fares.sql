@@ -0,0 +1,17 @@
+-- 初期データのライドには運賃の内訳が入っていないので、ライド作成時と同じ計算で埋める
+-- updated_at は元の値を保つ
+UPDATE rides
+SET base_fare    = 500,
+    metered_fare = 100 * (ABS(destination_latitude - pickup_latitude) + ABS(destination_longitude - pickup_longitude)),
+    surge_fare   = metered_fare * surge_percent DIV 100 - metered_fare,
+    updated_at   = updated_at;
+
+-- 割引はライドに紐づいたクーポンの割引額で、距離に応じた運賃 (サージ込み) を上限とする
+UPDATE rides
+  INNER JOIN coupons ON coupons.used_by = rides.id
+SET rides.discount   = LEAST(coupons.discount, rides.metered_fare + rides.surge_fare),
+    rides.updated_at = rides.updated_at;
+
+UPDATE rides
+SET total_fare = base_fare + metered_fare + surge_fare - discount,
+    updated_at = updated_at;
@@ -0,0 +1,4 @@
+-- 初期データのクーポンはコードの接頭辞で付与したキャンペーンを判別する
+UPDATE coupons SET campaign_id = '01JD9Q5N3R4V6X8Z0B2C4E6G8J' WHERE code = 'CP_NEW2024';
+UPDATE coupons SET campaign_id = '01JD9Q5N3R4V6X8Z0B2C4E6G8K' WHERE code LIKE 'INV\_%';
+UPDATE coupons SET campaign_id = '01JD9Q5N3R4V6X8Z0B2C4E6G8M' WHERE code LIKE 'RWD\_%';
@@ -0,0 +1,15 @@
+-- 初期データには招待テーブルが無いので、招待クーポンのコードから招待を復元する
+INSERT INTO referrals (invitee_id, inviter_id, invitation_code, created_at)
+SELECT coupons.user_id, users.id, users.invitation_code, coupons.created_at
+FROM coupons
+  INNER JOIN users ON coupons.code = CONCAT('INV_', users.invitation_code);
+
+-- 招待した側の報酬は招待と同時に付与されているので、招待したユーザーごとに古い順に対応づける
+INSERT INTO referral_rewards (invitee_id, coupon_code)
+SELECT referral.invitee_id, reward.code
+FROM (SELECT invitee_id, inviter_id, ROW_NUMBER() OVER (PARTITION BY inviter_id ORDER BY created_at, invitee_id) AS n
+      FROM referrals) AS referral
+  INNER JOIN (SELECT user_id, code, ROW_NUMBER() OVER (PARTITION BY user_id ORDER BY created_at, code) AS n
+              FROM coupons
+              WHERE code LIKE 'RWD\_%') AS reward
+             ON reward.user_id = referral.inviter_id AND reward.n = referral.n;
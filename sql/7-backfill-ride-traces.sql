@@ -0,0 +1,11 @@
+-- 初期データのライドを、状態の履歴から椅子の移動履歴の区間に紐づける
+UPDATE rides
+  INNER JOIN (SELECT ride_id,
+                     MAX(CASE WHEN status = 'ENROUTE' THEN created_at END) AS started_at,
+                     MAX(CASE WHEN status = 'ARRIVED' THEN created_at END) AS ended_at
+              FROM ride_statuses
+              GROUP BY ride_id) AS trace ON trace.ride_id = rides.id
+SET rides.trace_started_at = trace.started_at,
+    rides.trace_ended_at   = trace.ended_at,
+    rides.updated_at       = rides.updated_at
+WHERE rides.chair_id IS NOT NULL;
@@ -0,0 +1,31 @@
+-- 初期データの完了済みライドの仕訳を、完了した日時で計上する
+-- 手数料は割引前の運賃 (total_fare + discount) にかけ、chair_models に無いモデルは 10% とする
+INSERT INTO ledger_entries (ride_id, entry_type, owner_id, debit_account, credit_account, amount, created_at)
+SELECT rides.id, 'RIDER_CHARGE', chairs.owner_id, 'RIDER_RECEIVABLE', 'RIDE_CLEARING', rides.total_fare, ride_statuses.created_at
+FROM rides
+  INNER JOIN chairs ON chairs.id = rides.chair_id
+  INNER JOIN ride_statuses ON ride_statuses.ride_id = rides.id AND ride_statuses.status = 'COMPLETED';
+
+INSERT INTO ledger_entries (ride_id, entry_type, owner_id, debit_account, credit_account, amount, created_at)
+SELECT rides.id, 'COUPON_SUBSIDY', chairs.owner_id, 'COUPON_EXPENSE', 'RIDE_CLEARING', rides.discount, ride_statuses.created_at
+FROM rides
+  INNER JOIN chairs ON chairs.id = rides.chair_id
+  INNER JOIN ride_statuses ON ride_statuses.ride_id = rides.id AND ride_statuses.status = 'COMPLETED';
+
+INSERT INTO ledger_entries (ride_id, entry_type, owner_id, debit_account, credit_account, amount, created_at)
+SELECT rides.id, 'PLATFORM_FEE', chairs.owner_id, 'RIDE_CLEARING', 'PLATFORM_REVENUE',
+       (rides.total_fare + rides.discount) * COALESCE(chair_models.commission_percent, 10) DIV 100,
+       ride_statuses.created_at
+FROM rides
+  INNER JOIN chairs ON chairs.id = rides.chair_id
+  LEFT JOIN chair_models ON chair_models.name = chairs.model
+  INNER JOIN ride_statuses ON ride_statuses.ride_id = rides.id AND ride_statuses.status = 'COMPLETED';
+
+INSERT INTO ledger_entries (ride_id, entry_type, owner_id, debit_account, credit_account, amount, created_at)
+SELECT rides.id, 'OWNER_EARNINGS', chairs.owner_id, 'RIDE_CLEARING', 'OWNER_PAYABLE',
+       (rides.total_fare + rides.discount) - (rides.total_fare + rides.discount) * COALESCE(chair_models.commission_percent, 10) DIV 100,
+       ride_statuses.created_at
+FROM rides
+  INNER JOIN chairs ON chairs.id = rides.chair_id
+  LEFT JOIN chair_models ON chair_models.name = chairs.model
+  INNER JOIN ride_statuses ON ride_statuses.ride_id = rides.id AND ride_statuses.status = 'COMPLETED';
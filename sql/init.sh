@@ -30,10 +30,50 @@ mysql -u"$ISUCON_DB_USER" \
 		--port "$ISUCON_DB_PORT" \
 		"$ISUCON_DB_NAME" < 2-master-data.sql
 
+# 初期データはカラム名なしの INSERT なので、後から追加したカラムがあるテーブルはカラム名を明示する
 # INSERT INTO `chairs` VALUES を
 # INSERT INTO `chairs` (`id`, `owner_id`, `name`, `model`, `is_active`, `access_token`, `created_at`, `updated_at`) VALUES に変更
-gzip -dkc 3-initial-data.sql.gz | sed -e 's/INSERT INTO `chairs` VALUES/INSERT INTO `chairs` (`id`, `owner_id`, `name`, `model`, `is_active`, `access_token`, `created_at`, `updated_at`) VALUES/' | mysql -u"$ISUCON_DB_USER" \
+gzip -dkc 3-initial-data.sql.gz | sed \
+		-e 's/INSERT INTO `chairs` VALUES/INSERT INTO `chairs` (`id`, `owner_id`, `name`, `model`, `is_active`, `access_token`, `created_at`, `updated_at`) VALUES/' \
+		-e 's/INSERT INTO `coupons` VALUES/INSERT INTO `coupons` (`user_id`, `code`, `discount`, `created_at`, `used_by`) VALUES/' \
+		-e 's/INSERT INTO `rides` VALUES/INSERT INTO `rides` (`id`, `user_id`, `chair_id`, `pickup_latitude`, `pickup_longitude`, `destination_latitude`, `destination_longitude`, `evaluation`, `created_at`, `updated_at`) VALUES/' \
+		| mysql -u"$ISUCON_DB_USER" \
 		-p"$ISUCON_DB_PASSWORD" \
 		--host "$ISUCON_DB_HOST" \
 		--port "$ISUCON_DB_PORT" \
 		"$ISUCON_DB_NAME"
+
+# 初期データのライドに運賃の内訳を埋める
+mysql -u"$ISUCON_DB_USER" \
+		-p"$ISUCON_DB_PASSWORD" \
+		--host "$ISUCON_DB_HOST" \
+		--port "$ISUCON_DB_PORT" \
+		"$ISUCON_DB_NAME" < 4-backfill-ride-fares.sql
+
+# 初期データのクーポンをキャンペーンに紐づける
+mysql -u"$ISUCON_DB_USER" \
+		-p"$ISUCON_DB_PASSWORD" \
+		--host "$ISUCON_DB_HOST" \
+		--port "$ISUCON_DB_PORT" \
+		"$ISUCON_DB_NAME" < 5-backfill-coupon-campaigns.sql
+
+# 初期データの招待クーポンから招待を埋める
+mysql -u"$ISUCON_DB_USER" \
+		-p"$ISUCON_DB_PASSWORD" \
+		--host "$ISUCON_DB_HOST" \
+		--port "$ISUCON_DB_PORT" \
+		"$ISUCON_DB_NAME" < 6-backfill-referrals.sql
+
+# 初期データのライドを椅子の移動履歴の区間に紐づける
+mysql -u"$ISUCON_DB_USER" \
+		-p"$ISUCON_DB_PASSWORD" \
+		--host "$ISUCON_DB_HOST" \
+		--port "$ISUCON_DB_PORT" \
+		"$ISUCON_DB_NAME" < 7-backfill-ride-traces.sql
+
+# 初期データの完了済みライドの仕訳を計上する
+mysql -u"$ISUCON_DB_USER" \
+		-p"$ISUCON_DB_PASSWORD" \
+		--host "$ISUCON_DB_HOST" \
+		--port "$ISUCON_DB_PORT" \
+		"$ISUCON_DB_NAME" < 8-backfill-ledger.sql